@@ -0,0 +1,181 @@
+package httpslog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogKey is the key of the attribute carrying the completed request
+// on access log records.
+const accessLogKey = "accessLog"
+
+// accessLogLine describes a completed request for the access log. The
+// accessLogHandler renders it as a plain text line; other handlers, e.g.
+// one passed to NewLoggerFromHandler, log it as a group of fields.
+type accessLogLine struct {
+	request *http.Request
+	status  int
+	bytes   int
+	start   time.Time
+	elapsed time.Duration
+}
+
+func (l accessLogLine) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("remoteIP", l.host()),
+		slog.String("requestMethod", l.request.Method),
+		slog.String("requestURI", requestURI(l.request)),
+		slog.String("proto", l.request.Proto),
+		slog.Int("status", l.status),
+		slog.Int("bytes", l.bytes),
+		elapsedAttr(l.elapsed),
+	)
+}
+
+func (l accessLogLine) host() string {
+	host := remoteIP(l.request)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// appendCLF appends a single NCSA Common (or Combined) Log Format line
+// describing the completed request:
+//
+//	host ident authuser [date] "METHOD path proto" status bytes
+func (l accessLogLine) appendCLF(buf *bytes.Buffer, combined bool) {
+	r := l.request
+
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+
+	size := "-"
+	if l.bytes > 0 {
+		size = strconv.Itoa(l.bytes)
+	}
+
+	fmt.Fprintf(buf, "%s - %s [%s] %q %d %s",
+		l.host(),
+		user,
+		l.start.Format(accessLogTimeFormat),
+		fmt.Sprintf("%s %s %s", r.Method, requestURI(r), r.Proto),
+		l.status,
+		size,
+	)
+
+	if combined {
+		fmt.Fprintf(buf, " %q %q", accessLogField(r.Referer()), accessLogField(r.UserAgent()))
+	}
+
+	buf.WriteByte('\n')
+}
+
+// appendW3C appends a W3C Extended Log File Format line describing the
+// completed request, with the fields listed in w3cDirectives.
+func (l accessLogLine) appendW3C(buf *bytes.Buffer) {
+	start := l.start.UTC()
+	fmt.Fprintf(buf, "%s %s %s %s %s %d %.3f\n",
+		start.Format("2006-01-02"),
+		start.Format("15:04:05"),
+		l.host(),
+		l.request.Method,
+		accessLogField(l.request.URL.EscapedPath()),
+		l.status,
+		l.elapsed.Seconds(),
+	)
+}
+
+const w3cDirectives = "#Version: 1.0\n#Fields: date time c-ip cs-method cs-uri-stem sc-status time-taken\n"
+
+// accessLogHandler is a slog.Handler writing the access log records as
+// plain text lines in the given AccessLogFormat, or in the W3C Extended
+// Log File Format. Other records, such as the ones logged through
+// LogEntry, are written as JSON by next.
+type accessLogHandler struct {
+	out    *accessLogOutput
+	format string
+	next   slog.Handler
+}
+
+// accessLogOutput serializes the writes of an accessLogHandler and of its
+// JSON handler. It remembers whether the W3C directives were written.
+type accessLogOutput struct {
+	mu              sync.Mutex
+	w               io.Writer
+	wroteDirectives bool
+}
+
+func (o *accessLogOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.w.Write(p)
+}
+
+func newAccessLogHandler(w io.Writer, format string, opts *slog.HandlerOptions) *accessLogHandler {
+	out := &accessLogOutput{w: w}
+	return &accessLogHandler{out: out, format: format, next: slog.NewJSONHandler(out, opts)}
+}
+
+func (h *accessLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *accessLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var line accessLogLine
+	var ok bool
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == accessLogKey {
+			line, ok = a.Value.Any().(accessLogLine)
+		}
+		return !ok
+	})
+	if !ok {
+		return h.next.Handle(ctx, r)
+	}
+
+	var buf bytes.Buffer
+	if h.format == FormatW3C {
+		line.appendW3C(&buf)
+	} else {
+		line.appendCLF(&buf, h.format == AccessLogCombined)
+	}
+
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	if h.format == FormatW3C && !h.out.wroteDirectives {
+		if _, err := io.WriteString(h.out.w, w3cDirectives); err != nil {
+			return err
+		}
+		h.out.wroteDirectives = true
+	}
+	_, err := h.out.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *accessLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &accessLogHandler{out: h.out, format: h.format, next: h.next.WithAttrs(attrs)}
+}
+
+func (h *accessLogHandler) WithGroup(name string) slog.Handler {
+	return &accessLogHandler{out: h.out, format: h.format, next: h.next.WithGroup(name)}
+}
+
+func accessLogField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
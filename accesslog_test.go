@@ -0,0 +1,171 @@
+package httpslog
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clfLine matches host ident authuser [date] "request" status bytes, with
+// the optional "referer" "user-agent" of the Combined format.
+var clfLine = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\S+)(?: "([^"]*)" "([^"]*)")?$`)
+
+func TestAccessLogCommon(t *testing.T) {
+	logger, buf := testLogger(t, Options{AccessLogFormat: AccessLogCommon})
+	req := httptest.NewRequest("GET", "/users?id=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.SetBasicAuth("alice", "secret")
+	serve(logger, okHandler, req)
+
+	line := strings.TrimSuffix(buf.String(), "\n")
+	m := clfLine.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("not a CLF line: %q", line)
+	}
+	if m[1] != "192.0.2.1" || m[2] != "-" || m[3] != "alice" {
+		t.Errorf("host ident authuser = %q %q %q, want 192.0.2.1 - alice", m[1], m[2], m[3])
+	}
+	if _, err := time.Parse(accessLogTimeFormat, m[4]); err != nil {
+		t.Errorf("date %q: %v", m[4], err)
+	}
+	if m[5] != "GET /users?id=1 HTTP/1.1" {
+		t.Errorf("request = %q, want %q", m[5], "GET /users?id=1 HTTP/1.1")
+	}
+	if m[6] != "200" || m[7] != "2" {
+		t.Errorf("status bytes = %s %s, want 200 2", m[6], m[7])
+	}
+	if m[8] != "" || m[9] != "" {
+		t.Errorf("common line has combined fields: %q", line)
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	logger, buf := testLogger(t, Options{AccessLogFormat: AccessLogCombined})
+	req := httptest.NewRequest("POST", "/users", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	serve(logger, statusHandler(http.StatusNoContent), req)
+
+	line := strings.TrimSuffix(buf.String(), "\n")
+	m := clfLine.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("not a Combined line: %q", line)
+	}
+	if m[3] != "-" || m[6] != "204" || m[7] != "-" {
+		t.Errorf("authuser status bytes = %s %s %s, want - 204 -", m[3], m[6], m[7])
+	}
+	if m[8] != "-" || m[9] != "curl/8.0" {
+		t.Errorf("referer user-agent = %q %q, want - curl/8.0", m[8], m[9])
+	}
+}
+
+func TestAccessLogLevel(t *testing.T) {
+	logger, buf := testLogger(t, Options{AccessLogFormat: AccessLogCommon, LogLevel: "warn"})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/ok", nil))
+	serve(logger, statusHandler(http.StatusNotFound), httptest.NewRequest("GET", "/missing", nil))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"GET /missing HTTP/1.1" 404`) {
+		t.Errorf("want only the 404 line with LogLevel warn, got:\n%s", buf)
+	}
+}
+
+func TestAccessLogFromHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLoggerFromHandler("test", slog.NewJSONHandler(buf, nil), Options{AccessLogFormat: AccessLogCommon})
+	t.Cleanup(func() { Configure(Options{}) })
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if got := field(line, "accessLog", "requestURI"); got != "/users" {
+		t.Errorf("accessLog.requestURI = %v, want /users", got)
+	}
+	if got := field(line, "accessLog", "status"); got != float64(http.StatusOK) {
+		t.Errorf("accessLog.status = %v, want 200", got)
+	}
+}
+
+func TestAccessLogConcurrent(t *testing.T) {
+	logger, buf := testLogger(t, Options{AccessLogFormat: AccessLogCommon})
+	h := Handler(logger)(okHandler)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 20 {
+		t.Fatalf("got %d lines, want 20", len(lines))
+	}
+	for _, line := range lines {
+		if !clfLine.MatchString(line) {
+			t.Errorf("not a CLF line: %q", line)
+		}
+	}
+}
+
+func TestW3C(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatW3C})
+	req := httptest.NewRequest("GET", "/users/a%20b?id=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	serve(logger, okHandler, req)
+	serve(logger, statusHandler(http.StatusNotFound), httptest.NewRequest("POST", "/orders", nil))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 2 directives and 2 entries:\n%s", len(lines), buf)
+	}
+	if lines[0] != "#Version: 1.0" || lines[1] != "#Fields: date time c-ip cs-method cs-uri-stem sc-status time-taken" {
+		t.Errorf("directives = %q, %q", lines[0], lines[1])
+	}
+
+	fields := strings.Fields(lines[2])
+	if len(fields) != 7 {
+		t.Fatalf("got %d fields, want 7: %q", len(fields), lines[2])
+	}
+	if _, err := time.Parse("2006-01-02 15:04:05", fields[0]+" "+fields[1]); err != nil {
+		t.Errorf("date time %q %q: %v", fields[0], fields[1], err)
+	}
+	if want := []string{"192.0.2.1", "GET", "/users/a%20b", "200"}; strings.Join(fields[2:6], " ") != strings.Join(want, " ") {
+		t.Errorf("c-ip cs-method cs-uri-stem sc-status = %v, want %v", fields[2:6], want)
+	}
+	if !strings.HasPrefix(lines[3], fields[0]) || !strings.Contains(lines[3], " POST /orders 404 ") {
+		t.Errorf("second entry = %q", lines[3])
+	}
+}
+
+func TestW3CDirectivesOnce(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatW3C})
+	h := Handler(logger)(okHandler)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+		}()
+	}
+	wg.Wait()
+
+	if n := strings.Count(buf.String(), "#Fields:"); n != 1 {
+		t.Errorf("#Fields written %d times, want once", n)
+	}
+	if !strings.HasPrefix(buf.String(), "#Version: 1.0\n#Fields:") {
+		t.Errorf("log does not start with the directives:\n%s", buf)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 22 {
+		t.Errorf("got %d lines, want 22", n)
+	}
+}
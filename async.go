@@ -0,0 +1,93 @@
+package httpslog
+
+import (
+	"io"
+)
+
+// AsyncWriter hands log lines over to a background goroutine writing them
+// to the underlying writer, so request handlers don't wait on slow or
+// contended outputs. The queue is bounded: when it is full, lines are
+// dropped (and counted) unless blocking was requested.
+type AsyncWriter struct {
+	w     io.Writer
+	queue *lineQueue
+	block bool
+	flush chan chan struct{}
+	done  chan struct{}
+}
+
+func NewAsyncWriter(w io.Writer, size int, block bool) *AsyncWriter {
+	if size <= 0 {
+		size = 1024
+	}
+
+	a := &AsyncWriter{
+		w:     w,
+		queue: newLineQueue(size),
+		block: block,
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	if !a.queue.push(p, a.block) {
+		// Closed: write directly, once the queued lines are out.
+		<-a.done
+		return a.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// Flush blocks until all lines queued before the call have been written.
+func (a *AsyncWriter) Flush() {
+	reply := make(chan struct{})
+	select {
+	case a.flush <- reply:
+		<-reply
+	case <-a.done:
+	}
+}
+
+// Close drains the queue and stops the background goroutine. Lines
+// written after Close go straight to the underlying writer.
+func (a *AsyncWriter) Close() error {
+	a.queue.close()
+	<-a.done
+	return nil
+}
+
+// Dropped returns the number of lines dropped because the queue was full.
+func (a *AsyncWriter) Dropped() int64 {
+	return a.queue.dropped.Load()
+}
+
+func (a *AsyncWriter) run() {
+	defer close(a.done)
+
+	for {
+		select {
+		case rec := <-a.queue.records:
+			a.w.Write(rec)
+		case reply := <-a.flush:
+			a.drain()
+			close(reply)
+		case <-a.queue.quit:
+			a.drain()
+			return
+		}
+	}
+}
+
+func (a *AsyncWriter) drain() {
+	for {
+		select {
+		case rec := <-a.queue.records:
+			a.w.Write(rec)
+		default:
+			return
+		}
+	}
+}
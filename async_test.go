@@ -0,0 +1,141 @@
+package httpslog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAsyncWriterClose(t *testing.T) {
+	buf := &syncBuffer{}
+	a := NewAsyncWriter(buf, 16, true)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(a, "line %d\n", i)
+	}
+	a.Close()
+
+	if n := strings.Count(buf.String(), "\n"); n != 1000 {
+		t.Errorf("got %d lines after Close, want 1000", n)
+	}
+
+	a.Write([]byte("after close\n"))
+	if !strings.HasSuffix(buf.String(), "line 999\nafter close\n") {
+		t.Error("line written after Close not passed through")
+	}
+}
+
+func TestAsyncWriterCloseConcurrent(t *testing.T) {
+	buf := &syncBuffer{}
+	a := NewAsyncWriter(buf, 10000, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				a.Write([]byte("line\n"))
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	a.Close()
+	wg.Wait()
+
+	if n := strings.Count(buf.String(), "\n"); n != 8*500 {
+		t.Errorf("got %d lines, want %d: lines written around Close were lost", n, 8*500)
+	}
+}
+
+// blockingWriter holds every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+	buf     syncBuffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriterDropped(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	a := NewAsyncWriter(w, 1, false)
+	for i := 0; i < 10; i++ {
+		a.Write([]byte("line\n"))
+	}
+	close(w.release)
+	a.Close()
+
+	written := int64(strings.Count(w.buf.String(), "\n"))
+	if a.Dropped() < 8 || written+a.Dropped() != 10 {
+		t.Errorf("written %d, dropped %d, want at least 8 of 10 dropped", written, a.Dropped())
+	}
+}
+
+func TestAsyncOption(t *testing.T) {
+	buf := &syncBuffer{}
+	logger := NewLogger("test", Options{Async: true, Writers: []io.Writer{buf}})
+	t.Cleanup(func() { Configure(Options{}) })
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	Flush()
+
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Errorf("got %d lines after Flush, want 2", n)
+	}
+}
+
+// slowWriter simulates a contended output, such as a pipe read by a busy
+// log collector.
+type slowWriter struct {
+	mu sync.Mutex
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	time.Sleep(20 * time.Microsecond)
+	return len(p), nil
+}
+
+func BenchmarkAsync(b *testing.B) {
+	for _, async := range []bool{false, true} {
+		b.Run(fmt.Sprintf("async=%v", async), func(b *testing.B) {
+			logger := NewLogger("bench", Options{Async: async, Writers: []io.Writer{&slowWriter{}}})
+			b.Cleanup(func() { Configure(Options{}) })
+			h := Handler(logger)(okHandler)
+			req := httptest.NewRequest("GET", "/users", nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					h.ServeHTTP(httptest.NewRecorder(), req)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package httpslog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var ErrBatchHandlerClosed = errors.New("httpslog: batch handler closed")
+
+type BatchOptions struct {
+	// MaxBatchSize is the number of records sent per request (default 100).
+	MaxBatchSize int
+	// FlushInterval is the maximum time a record waits before being sent
+	// (default 1s).
+	FlushInterval time.Duration
+	// MaxPending bounds the number of records held in memory (default 10000).
+	MaxPending int
+	// DropWhenFull drops records instead of blocking the caller when
+	// MaxPending is reached.
+	DropWhenFull bool
+	// MaxRetries is the number of retries for a failed batch (default 3,
+	// negative disables retries).
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled on each
+	// subsequent attempt (default 500ms).
+	RetryBackoff time.Duration
+	// Client sends the batches. Defaults to a client with a 10s timeout,
+	// so a hung endpoint can't stall the queue, and with it the logging
+	// callers, indefinitely.
+	Client *http.Client
+	Level  slog.Leveler
+}
+
+const defaultBatchTimeout = 10 * time.Second
+
+// BatchHandler is a slog.Handler that accumulates JSON records and ships
+// them to an HTTP endpoint as newline-delimited JSON, flushing when a
+// batch is full or FlushInterval elapses. Call Close on shutdown to flush
+// pending records.
+type BatchHandler struct {
+	slog.Handler
+	w *batchWriter
+}
+
+func NewBatchHandler(endpoint string, opts BatchOptions) *BatchHandler {
+	w := newBatchWriter(endpoint, opts)
+	return &BatchHandler{
+		Handler: slog.NewJSONHandler(w, &slog.HandlerOptions{Level: opts.Level}),
+		w:       w,
+	}
+}
+
+// Close stops accepting records and flushes any pending ones, waiting
+// until they are sent or ctx is done.
+func (h *BatchHandler) Close(ctx context.Context) error {
+	return h.w.Close(ctx)
+}
+
+// Dropped returns the number of records dropped because the queue was
+// full or a batch could not be delivered.
+func (h *BatchHandler) Dropped() int64 {
+	return h.w.queue.dropped.Load()
+}
+
+type batchWriter struct {
+	endpoint string
+	opts     BatchOptions
+	queue    *lineQueue
+	done     chan struct{}
+}
+
+func newBatchWriter(endpoint string, opts BatchOptions) *batchWriter {
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 10000
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 500 * time.Millisecond
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultBatchTimeout}
+	}
+
+	w := &batchWriter{
+		endpoint: endpoint,
+		opts:     opts,
+		queue:    newLineQueue(opts.MaxPending),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *batchWriter) Write(p []byte) (int, error) {
+	if !w.queue.push(p, !w.opts.DropWhenFull) {
+		return 0, ErrBatchHandlerClosed
+	}
+	return len(p), nil
+}
+
+func (w *batchWriter) Close(ctx context.Context) error {
+	// Writers blocked on a full queue hold it until the consumer makes
+	// room, so don't let closing it outlast ctx.
+	go w.queue.close()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *batchWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, w.opts.MaxBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			w.send(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case rec := <-w.queue.records:
+			batch = append(batch, rec)
+			if len(batch) >= w.opts.MaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-w.queue.quit:
+			for {
+				select {
+				case rec := <-w.queue.records:
+					batch = append(batch, rec)
+					if len(batch) >= w.opts.MaxBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts the batch, retrying with exponential backoff. Records of a
+// batch that still fails after MaxRetries are counted as dropped.
+func (w *batchWriter) send(batch [][]byte) {
+	body := bytes.Join(batch, nil)
+
+	backoff := w.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.opts.MaxRetries {
+			w.queue.dropped.Add(int64(len(batch)))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *batchWriter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("httpslog: batch endpoint returned %s", resp.Status)
+	}
+	return nil
+}
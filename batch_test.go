@@ -0,0 +1,146 @@
+package httpslog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchServer records the number of lines of each batch it receives,
+// failing the first failures requests with a 500.
+type batchServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	batches  []int
+	failures int
+}
+
+func newBatchServer(t *testing.T, failures int) *batchServer {
+	s := &batchServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.failures != 0 {
+			s.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		lines := 0
+		for sc := bufio.NewScanner(r.Body); sc.Scan(); {
+			lines++
+		}
+		s.batches = append(s.batches, lines)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *batchServer) received() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.batches...)
+}
+
+func TestBatchHandler(t *testing.T) {
+	srv := newBatchServer(t, 0)
+	h := NewBatchHandler(srv.URL, BatchOptions{MaxBatchSize: 2, FlushInterval: time.Hour})
+	logger := slog.New(h)
+	for i := 0; i < 5; i++ {
+		logger.Info("request", "i", i)
+	}
+	if err := h.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := srv.received()
+	if len(got) != 3 || got[0] != 2 || got[1] != 2 || got[2] != 1 {
+		t.Errorf("got batches of %v lines, want [2 2 1]", got)
+	}
+	if err := h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "late", 0)); !errors.Is(err, ErrBatchHandlerClosed) {
+		t.Errorf("Handle after Close = %v, want ErrBatchHandlerClosed", err)
+	}
+}
+
+func TestBatchHandlerFlushInterval(t *testing.T) {
+	srv := newBatchServer(t, 0)
+	h := NewBatchHandler(srv.URL, BatchOptions{FlushInterval: 10 * time.Millisecond})
+	defer h.Close(context.Background())
+	slog.New(h).Info("request")
+
+	deadline := time.Now().Add(time.Second)
+	for len(srv.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch not flushed after FlushInterval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatchHandlerRetry(t *testing.T) {
+	srv := newBatchServer(t, 2)
+	h := NewBatchHandler(srv.URL, BatchOptions{FlushInterval: time.Hour, RetryBackoff: time.Millisecond})
+	slog.New(h).Info("request")
+	h.Close(context.Background())
+
+	if got := srv.received(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("got batches of %v lines, want [1] after retries", got)
+	}
+	if n := h.Dropped(); n != 0 {
+		t.Errorf("Dropped() = %d, want 0", n)
+	}
+}
+
+func TestBatchHandlerDropsUndelivered(t *testing.T) {
+	srv := newBatchServer(t, -1)
+	h := NewBatchHandler(srv.URL, BatchOptions{FlushInterval: time.Hour, MaxRetries: -1})
+	logger := slog.New(h)
+	logger.Info("one")
+	logger.Info("two")
+	h.Close(context.Background())
+
+	if n := h.Dropped(); n != 2 {
+		t.Errorf("Dropped() = %d, want 2", n)
+	}
+}
+
+func TestBatchHandlerCloseHungEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	h := NewBatchHandler(srv.URL, BatchOptions{MaxBatchSize: 1, MaxPending: 1, MaxRetries: -1})
+	logger := slog.New(h)
+	// The first line is stuck in the send, the second fills the queue
+	// and the third blocks its caller.
+	logger.Info("one")
+	logger.Info("two")
+	go logger.Info("three")
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := h.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %v, want it bounded by ctx", elapsed)
+	}
+}
+
+func TestBatchHandlerDefaultClientTimeout(t *testing.T) {
+	h := NewBatchHandler("http://127.0.0.1:0", BatchOptions{})
+	defer h.Close(context.Background())
+	if got := h.w.opts.Client.Timeout; got != defaultBatchTimeout {
+		t.Errorf("default client timeout = %v, want %v", got, defaultBatchTimeout)
+	}
+}
@@ -0,0 +1,90 @@
+package httpslog
+
+import (
+	"sync"
+	"time"
+)
+
+// coalescer collapses identical consecutive response log lines. The first
+// line of a run is logged right away; repeats arriving within the window
+// are held back and summarized by logging the last of them once, with a
+// repeated count, when the window ends or a different line comes in.
+// Each Handler has its own, so lines of different loggers never merge.
+type coalescer struct {
+	mu       sync.Mutex
+	key      string
+	repeated int
+	last     func(repeated int)
+	gen      int
+}
+
+// activeCoalescers are the coalescers with a run in progress, for Flush
+// and Shutdown.
+var (
+	activeMu         sync.Mutex
+	activeCoalescers = map[*coalescer]struct{}{}
+)
+
+// log emits a line identified by key through emit, unless it repeats the
+// previous line within window.
+func (c *coalescer) log(key string, window time.Duration, emit func(repeated int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.key != "" && key == c.key {
+		c.repeated++
+		c.last = emit
+		return
+	}
+
+	c.flushLocked()
+	c.key = key
+	activeMu.Lock()
+	activeCoalescers[c] = struct{}{}
+	activeMu.Unlock()
+	gen := c.gen
+	time.AfterFunc(window, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.gen == gen {
+			c.flushLocked()
+		}
+	})
+	emit(0)
+}
+
+// flush ends the current run, logging its summary line if any.
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+func (c *coalescer) flushLocked() {
+	if c.repeated > 0 {
+		c.last(c.repeated)
+	}
+	if c.key != "" {
+		activeMu.Lock()
+		delete(activeCoalescers, c)
+		activeMu.Unlock()
+	}
+	c.key = ""
+	c.repeated = 0
+	c.last = nil
+	c.gen++
+}
+
+// flushCoalescers ends the runs of all Handlers.
+func flushCoalescers() {
+	activeMu.Lock()
+	active := make([]*coalescer, 0, len(activeCoalescers))
+	for c := range activeCoalescers {
+		active = append(active, c)
+	}
+	activeMu.Unlock()
+
+	for _, c := range active {
+		c.flush()
+	}
+}
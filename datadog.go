@@ -0,0 +1,48 @@
+package httpslog
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// datadogResponseAttrs is like datadogAttrs but also carries the response
+// status code, the duration in nanoseconds and the log status.
+func datadogResponseAttrs(r *http.Request, status int, elapsed time.Duration, level slog.Level) []slog.Attr {
+	attrs := datadogAttrs(r, slog.Int("status_code", status))
+	return append(attrs,
+		slog.Int64("duration", elapsed.Nanoseconds()),
+		slog.String("status", datadogStatus(level)),
+	)
+}
+
+// datadogAttrs maps the request fields onto Datadog's reserved attribute
+// names (http.*, network.client.ip).
+func datadogAttrs(r *http.Request, extra ...slog.Attr) []slog.Attr {
+	httpAttrs := []slog.Attr{
+		slog.String("url", requestURL(r)),
+		slog.String("method", r.Method),
+	}
+	if reqID := RequestID(r.Context()); reqID != "" {
+		httpAttrs = append(httpAttrs, slog.String(DefaultOptions.RequestIDFieldName, reqID))
+	}
+	httpAttrs = append(httpAttrs, extra...)
+
+	return []slog.Attr{
+		{Key: "http", Value: slog.GroupValue(httpAttrs...)},
+		slog.Group("network", slog.Group("client", "ip", remoteIP(r))),
+	}
+}
+
+func datadogStatus(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "error"
+	case level >= slog.LevelWarn:
+		return "warning"
+	case level >= slog.LevelInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
@@ -0,0 +1,66 @@
+package httpslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestDatadogFormat(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatDatadog, RequestIDFieldName: "request_id"})
+	req := httptest.NewRequest("GET", "/users?id=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	middleware.RequestID(Handler(logger)(statusHandler(http.StatusInternalServerError))).ServeHTTP(rec, req)
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf)
+	}
+	for _, line := range lines {
+		if got := field(line, "http", "method"); got != "GET" {
+			t.Errorf("http.method = %v, want GET", got)
+		}
+		if got := field(line, "http", "url"); got != "http://example.com/users?id=1" {
+			t.Errorf("http.url = %v", got)
+		}
+		if got := field(line, "http", "request_id"); got == nil || got == "" {
+			t.Errorf("http.request_id missing:\n%s", buf)
+		}
+		if got := field(line, "network", "client", "ip"); got != "192.0.2.1:1234" {
+			t.Errorf("network.client.ip = %v, want 192.0.2.1:1234", got)
+		}
+	}
+
+	resp := lines[1]
+	if got := field(resp, "http", "status_code"); got != float64(http.StatusInternalServerError) {
+		t.Errorf("http.status_code = %v, want 500", got)
+	}
+	if got := resp["status"]; got != "error" {
+		t.Errorf("status = %v, want error", got)
+	}
+	if _, ok := resp["duration"].(float64); !ok {
+		t.Errorf("duration = %v, want nanoseconds", resp["duration"])
+	}
+	if _, ok := resp["httpResponse"]; ok {
+		t.Errorf("httpResponse group logged in datadog format:\n%s", buf)
+	}
+}
+
+func TestDatadogStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusOK, "info"},
+		{http.StatusNotFound, "warning"},
+		{http.StatusBadGateway, "error"},
+	}
+	for _, tt := range tests {
+		if got := datadogStatus(statusLevel(tt.status)); got != tt.want {
+			t.Errorf("datadogStatus(statusLevel(%d)) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
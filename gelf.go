@@ -0,0 +1,187 @@
+package httpslog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// gelfHandler is a slog.Handler writing Graylog Extended Log Format
+// (GELF 1.1) JSON records. Attributes are flattened into "_"-prefixed
+// additional fields, with nested group keys joined by "_".
+type gelfHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	opts   slog.HandlerOptions
+	host   string
+	fields map[string]any
+	groups []string
+}
+
+// newGELFHandler returns a gelfHandler logging host as the GELF host, or
+// os.Hostname() when host is empty.
+func newGELFHandler(w io.Writer, host string, opts *slog.HandlerOptions) *gelfHandler {
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	h := &gelfHandler{w: w, mu: &sync.Mutex{}, host: host, fields: map[string]any{}}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Level == nil {
+		h.opts.Level = slog.LevelInfo
+	}
+	return h
+}
+
+func (h *gelfHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+func (h *gelfHandler) Handle(_ context.Context, r slog.Record) error {
+	record := make(map[string]any, len(h.fields)+r.NumAttrs()+8)
+	for k, v := range h.fields {
+		record[k] = v
+	}
+	if h.opts.AddSource && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		h.addField(record, nil, slog.Any(slog.SourceKey, &slog.Source{
+			Function: frame.Function,
+			File:     frame.File,
+			Line:     frame.Line,
+		}))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		h.addField(record, h.groups, a)
+		return true
+	})
+
+	record["version"] = "1.1"
+	record["host"] = h.host
+	record["short_message"] = r.Message
+
+	// The built-in attributes go through ReplaceAttr too, which can drop
+	// the optional timestamp and level.
+	if !r.Time.IsZero() {
+		if a := h.replaceAttr(slog.Time(slog.TimeKey, r.Time)); a.Key != "" && a.Value.Kind() == slog.KindTime {
+			record["timestamp"] = float64(a.Value.Time().UnixNano()) / 1e9
+		}
+	}
+	if a := h.replaceAttr(slog.Any(slog.LevelKey, r.Level)); a.Key != "" {
+		level := r.Level
+		if l, ok := a.Value.Any().(slog.Level); ok {
+			level = l
+		}
+		record["level"] = syslogSeverity(level)
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.w.Write(buf)
+	return err
+}
+
+func (h *gelfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fields = make(map[string]any, len(h.fields)+len(attrs))
+	for k, v := range h.fields {
+		h2.fields[k] = v
+	}
+	for _, a := range attrs {
+		h.addField(h2.fields, h.groups, a)
+	}
+	return &h2
+}
+
+func (h *gelfHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &h2
+}
+
+func (h *gelfHandler) replaceAttr(a slog.Attr) slog.Attr {
+	if h.opts.ReplaceAttr == nil {
+		return a
+	}
+	a = h.opts.ReplaceAttr(nil, a)
+	a.Value = a.Value.Resolve()
+	return a
+}
+
+func (h *gelfHandler) addField(fields map[string]any, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], a.Key)
+		}
+		for _, ga := range a.Value.Group() {
+			h.addField(fields, groups, ga)
+		}
+		return
+	}
+
+	if h.opts.ReplaceAttr != nil {
+		a = h.opts.ReplaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+	if a.Key == "" {
+		return
+	}
+
+	if src, ok := a.Value.Any().(*slog.Source); ok {
+		groups = append(groups[:len(groups):len(groups)], a.Key)
+		fields[gelfKey(groups, "function")] = src.Function
+		fields[gelfKey(groups, "file")] = src.File
+		fields[gelfKey(groups, "line")] = src.Line
+		return
+	}
+
+	// GELF additional fields must be strings or numbers.
+	switch a.Value.Kind() {
+	case slog.KindInt64, slog.KindUint64, slog.KindFloat64:
+		fields[gelfKey(groups, a.Key)] = a.Value.Any()
+	default:
+		fields[gelfKey(groups, a.Key)] = a.Value.String()
+	}
+}
+
+// gelfKey returns the additional field name of key, e.g. _httpResponse_status.
+func gelfKey(groups []string, key string) string {
+	var b strings.Builder
+	for _, g := range groups {
+		b.WriteByte('_')
+		b.WriteString(g)
+	}
+	b.WriteByte('_')
+	b.WriteString(key)
+	return b.String()
+}
+
+// syslogSeverity maps a slog level onto the RFC 5424 numeric severity.
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
@@ -0,0 +1,70 @@
+package httpslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGELF(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatGELF, Hostname: "web-1"})
+	serve(logger, statusHandler(http.StatusNotFound), httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if line["version"] != "1.1" || line["host"] != "web-1" || line["short_message"] != "Response: 404 Client Error" {
+		t.Errorf("version, host, short_message = %v, %v, %v", line["version"], line["host"], line["short_message"])
+	}
+	if _, ok := line["timestamp"].(float64); !ok {
+		t.Errorf("timestamp = %v, want a number", line["timestamp"])
+	}
+	if line["level"] != float64(4) {
+		t.Errorf("level = %v, want syslog warning (4)", line["level"])
+	}
+	if line["_httpResponse_status"] != float64(http.StatusNotFound) || line["_httpRequest_requestPath"] != "/users" {
+		t.Errorf("additional fields missing:\n%s", buf)
+	}
+	for key := range line {
+		switch key {
+		case "version", "host", "short_message", "timestamp", "level":
+		default:
+			if !strings.HasPrefix(key, "_") {
+				t.Errorf("additional field %q without _ prefix", key)
+			}
+		}
+	}
+}
+
+func TestGELFReplaceAttr(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		Format:      FormatGELF,
+		OmitTime:    true,
+		FieldRename: map[string]string{"status": "statusCode"},
+		DropFields:  []string{"proto"},
+	})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if _, ok := line["timestamp"]; ok {
+		t.Error("timestamp logged with OmitTime")
+	}
+	if line["_httpResponse_statusCode"] != float64(200) || line["_httpResponse_status"] != nil {
+		t.Errorf("status not renamed:\n%s", buf)
+	}
+	if _, ok := line["_httpRequest_proto"]; ok {
+		t.Errorf("dropped proto logged:\n%s", buf)
+	}
+}
+
+func TestGELFAddSource(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatGELF, AddSource: true})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if file, _ := line["_source_file"].(string); !strings.HasSuffix(file, ".go") {
+		t.Errorf("_source_file = %v", line["_source_file"])
+	}
+	if _, ok := line["_source_line"].(float64); !ok {
+		t.Errorf("_source_line = %v", line["_source_line"])
+	}
+}
@@ -2,11 +2,19 @@ package httpslog
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -14,15 +22,49 @@ import (
 )
 
 func NewLogger(serviceName string, opts ...Options) *slog.Logger {
+	options := DefaultOptions
 	if len(opts) > 0 {
-		Configure(opts[0])
-	} else {
-		Configure(DefaultOptions)
+		options = opts[0]
+	}
+	Configure(options)
+	return newLogger(serviceName, slog.Default(), options)
+}
+
+// NewLoggerFromHandler is like NewLogger but logs through h, e.g. an
+// application's existing handler, instead of one built by Configure. The
+// default slog logger is left untouched, and options configuring the
+// built-in handler, such as Format, OmitTime or ReplaceAttr, have no
+// effect. The options still replace DefaultOptions: LogLevel decides
+// whether Concise mode applies (see SetLevel), and FieldRename and
+// DropFields still apply to the httpRequest and httpResponse group keys.
+func NewLoggerFromHandler(serviceName string, h slog.Handler, opts Options) *slog.Logger {
+	opts = setOptions(opts)
+	if opts.NumericLevel {
+		h = &severityHandler{h}
+	}
+	return newLogger(serviceName, slog.New(h), opts)
+}
+
+func newLogger(serviceName string, base *slog.Logger, options Options) *slog.Logger {
+	if !options.PreserveServiceCase {
+		serviceName = strings.ToLower(serviceName)
+	}
+	logger := base.With("service", serviceName)
+
+	hostname := options.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	if hostname != "" {
+		logger = logger.With("hostname", hostname)
+	}
+
+	if len(options.Tags) > 0 {
+		logger = logger.With("tags", options.Tags)
 	}
 
-	logger := slog.With("service", strings.ToLower(serviceName))
-	if len(DefaultOptions.Tags) > 0 {
-		logger = logger.With("tags", DefaultOptions.Tags)
+	if options.SchemaVersion != "" {
+		logger = logger.With("schemaVersion", options.SchemaVersion)
 	}
 
 	return logger
@@ -36,12 +78,46 @@ func RequestLogger(logger *slog.Logger, skipPaths ...[]string) func(next http.Ha
 	).Handler
 }
 
+// Config selects the middleware bundled by RequestLoggerWith.
+type Config struct {
+	RequestID bool
+	Recoverer bool
+	SkipPaths []string
+}
+
+// RequestLoggerWith is like RequestLogger but lets callers leave out the
+// bundled RequestID and Recoverer middleware, e.g. when the application
+// already installs them itself.
+func RequestLoggerWith(logger *slog.Logger, cfg Config) func(next http.Handler) http.Handler {
+	var middlewares chi.Middlewares
+	if cfg.RequestID {
+		middlewares = append(middlewares, middleware.RequestID)
+	}
+	middlewares = append(middlewares, Handler(logger, cfg.SkipPaths))
+	if cfg.Recoverer {
+		middlewares = append(middlewares, middleware.Recoverer)
+	}
+	return chi.Chain(middlewares...).Handler
+}
+
+// StdHandler returns the request logging middleware for plain net/http
+// servers such as http.ServeMux. It needs no chi router: its signature and
+// the wrapped handler only use net/http types, and the status and byte
+// counts come from a wrapped http.ResponseWriter. The logged fields match
+// the chi middleware, except for chi route data such as SkipRoutePatterns
+// and LogURLParams.
+func StdHandler(logger *slog.Logger, cfg Config) func(next http.Handler) http.Handler {
+	return RequestLoggerWith(logger, cfg)
+}
+
 func Handler(logger *slog.Logger, optSkipPaths ...[]string) func(next http.Handler) http.Handler {
-	var f middleware.LogFormatter = &requestLogger{logger}
+	var f middleware.LogFormatter = &requestLogger{Logger: logger, coalescer: &coalescer{}}
+
+	var inFlight atomic.Int64
 
 	skipPaths := map[string]struct{}{}
-	if len(optSkipPaths) > 0 {
-		for _, path := range optSkipPaths[0] {
+	for _, paths := range optSkipPaths {
+		for _, path := range paths {
 			skipPaths[path] = struct{}{}
 		}
 	}
@@ -56,152 +132,746 @@ func Handler(logger *slog.Logger, optSkipPaths ...[]string) func(next http.Handl
 					return
 				}
 			}
+			if DefaultOptions.SkipDefaultPaths && slices.Contains(defaultSkipPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if DefaultOptions.SkipFunc != nil && DefaultOptions.SkipFunc(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Reuse an upstream request ID when present
+			if DefaultOptions.RequestIDHeader != "" {
+				if reqID := r.Header.Get(DefaultOptions.RequestIDHeader); reqID != "" {
+					r = r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, reqID))
+				}
+			}
+
+			if DefaultOptions.ResponseRequestIDHeader != "" {
+				if reqID := RequestID(r.Context()); reqID != "" {
+					w.Header().Set(DefaultOptions.ResponseRequestIDHeader, reqID)
+				}
+			}
+
+			// Count the requests in flight, including this one
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			r = r.WithContext(context.WithValue(r.Context(), inFlightCtxKey, n))
+
+			if DefaultOptions.LogBodyHash {
+				r = withBodyHash(r)
+			}
 
 			// Log the request
-			entry := f.NewLogEntry(r)
+			entry := f.NewLogEntry(r).(*RequestLoggerEntry)
+			if DefaultOptions.ServerTimingHeader {
+				w = &serverTimingWriter{ResponseWriter: w, start: now()}
+			}
 			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 
-			buf := newLimitBuffer(512)
-			ww.Tee(buf)
+			// Upgraded connections are hijacked, so there is no response
+			// body worth capturing. Streams are filtered out on write. In
+			// Concise mode or with OmitResponseBody the body is never
+			// logged, so skip the buffer.
+			var buf io.ReadWriter
+			if upgradeProtocol(r) == "" && !DefaultOptions.OmitResponseBody && (DefaultOptions.LogResponseBody || !isConcise(r.Context())) {
+				buf = newLimitBuffer(512)
+				ww.Tee(bodyCapture{buf: buf, header: ww.Header(), entry: entry})
+			}
+
+			// The entry is stored under chi's key too, for middleware.Recoverer
+			// and other users of middleware.GetLogEntry.
+			r = middleware.WithLogEntry(r, entry)
+			r = r.WithContext(context.WithValue(r.Context(), logEntryCtxKey, entry))
 
-			t1 := time.Now()
+			t1 := now()
 			defer func() {
+				if DefaultOptions.AfterRequest != nil {
+					DefaultOptions.AfterRequest(r.Context(), ww.Status())
+				}
+
 				var respBody []byte
-				if ww.Status() >= 400 {
+				if buf != nil && ww.Status() >= 400 {
 					respBody, _ = ioutil.ReadAll(buf)
 				}
-				entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), time.Since(t1), respBody)
+				entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), now().Sub(t1), respBody)
 			}()
 
-			next.ServeHTTP(ww, middleware.WithLogEntry(r, entry))
+			if DefaultOptions.BeforeRequest != nil {
+				DefaultOptions.BeforeRequest(r.Context(), r)
+			}
+
+			if timeout := DefaultOptions.RequestTimeout; timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				http.TimeoutHandler(next, timeout, "").ServeHTTP(ww, r.WithContext(ctx))
+				entry.timedOut = errors.Is(ctx.Err(), context.DeadlineExceeded) && ww.Status() == http.StatusServiceUnavailable
+				return
+			}
+
+			next.ServeHTTP(ww, r)
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
+// defaultSkipPaths are the health-check and metrics endpoints skipped
+// with SkipDefaultPaths.
+var defaultSkipPaths = []string{"/health", "/healthz", "/ready", "/metrics", "/ping"}
+
 type requestLogger struct {
-	Logger *slog.Logger
+	Logger    *slog.Logger
+	coalescer *coalescer
 }
 
 func (l *requestLogger) NewLogEntry(r *http.Request) middleware.LogEntry {
-	entry := &RequestLoggerEntry{}
-	msg := fmt.Sprintf("Request: %s %s", r.Method, r.URL.Path)
-	entry.Logger = l.Logger.With("httpRequest", requestLogFields(r, true))
-	if !DefaultOptions.Concise {
-		entry.Logger.With("httpRequest", requestLogFields(r, DefaultOptions.Concise)).Info(msg)
+	entry := &RequestLoggerEntry{Logger: l.Logger, request: r, coalescer: l.coalescer}
+	if level, ok := pathLevel(r.URL.Path); ok {
+		entry.Logger = slog.New(&levelHandler{l.Logger.Handler(), level})
+	}
+	concise := isConcise(r.Context())
+	if DefaultOptions.UserContextKey != nil {
+		if user := r.Context().Value(DefaultOptions.UserContextKey); user != nil {
+			entry.Logger = entry.Logger.With(slog.Any(DefaultOptions.UserFieldName, user))
+		}
+	}
+
+	if DefaultOptions.AccessLogFormat != "" || DefaultOptions.Format == FormatW3C {
+		return entry
+	}
+
+	if DefaultOptions.Format == FormatDatadog {
+		if (!concise || DefaultOptions.LogRequestStart) && !DefaultOptions.UnifiedEntry {
+			entry.logRequest(entry.Logger, datadogAttrs(r)...)
+		}
+		return entry
+	}
+
+	// With a FieldGroup, request fields are attached at response time so
+	// both groups can be nested under the same key.
+	if DefaultOptions.FieldGroup != "" {
+		if (!concise || DefaultOptions.LogRequestStart) && !DefaultOptions.UnifiedEntry {
+			requestAttrs := httpFields("httpRequest", requestLogFields(r, concise))
+			entry.logRequest(entry.Logger, groupAttr(DefaultOptions.FieldGroup, requestAttrs))
+		}
+		return entry
+	}
+
+	if DefaultOptions.UnifiedEntry {
+		entry.Logger = slog.New(entry.Logger.Handler().WithAttrs(httpFields("httpRequest", requestLogFields(r, concise))))
+		return entry
+	}
+
+	entry.Logger = slog.New(entry.Logger.Handler().WithAttrs(httpFields("httpRequest", requestLogFields(r, true))))
+	if !concise {
+		entry.logRequest(entry.Logger, httpFields("httpRequest", requestLogFields(r, false))...)
+	} else if DefaultOptions.LogRequestStart {
+		entry.logRequest(entry.Logger)
 	}
 	return entry
 }
 
 type RequestLoggerEntry struct {
-	Logger *slog.Logger
-	msg    string
+	Logger   *slog.Logger
+	msg      string
+	request  *http.Request
+	panicked bool
+	err      error
+
+	noBodyCapture bool
+	verbose       bool
+	timedOut      bool
+
+	pendingRequestLog func()
+
+	// coalescer collapses repeated response lines of the entry's Handler.
+	coalescer *coalescer
+
+	// base is the logger before any custom fields were set, so they can
+	// be rebuilt by LogEntryRemoveField.
+	base   *slog.Logger
+	fields []slog.Attr
+
+	// errorFields are only logged on error responses and panics.
+	errorFields []slog.Attr
+
+	// mu guards the fields above against a handler that keeps running
+	// after RequestTimeout; once finished is set by Write, the entry no
+	// longer changes.
+	mu       sync.Mutex
+	finished bool
+}
+
+// update runs fn with the entry locked, unless its response was already
+// logged. A handler abandoned by RequestTimeout may still call the
+// LogEntry setters while, or after, Write runs.
+func (l *RequestLoggerEntry) update(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.finished {
+		fn()
+	}
+}
+
+// with attaches custom fields to the entry's logger, keeping track of
+// them for LogEntryRemoveField.
+func (l *RequestLoggerEntry) with(attrs ...slog.Attr) {
+	if l.base == nil {
+		l.base = l.Logger
+	}
+	l.fields = append(l.fields, attrs...)
+	l.Logger = slog.New(l.Logger.Handler().WithAttrs(attrs))
+}
+
+// logRequest emits the request log line. With LogOnlyErrors it is held
+// back until Write knows the response status.
+func (l *RequestLoggerEntry) logRequest(logger *slog.Logger, attrs ...slog.Attr) {
+	msg := requestMsg(l.request)
+	log := func() {
+		logger.LogAttrs(l.request.Context(), slog.LevelInfo, msg, attrs...)
+	}
+
+	if DefaultOptions.LogOnlyErrors {
+		l.pendingRequestLog = log
+		return
+	}
+	log()
 }
 
 func (l *RequestLoggerEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
-	msg := fmt.Sprintf("Response: %d %s", status, statusLabel(status))
+	l.mu.Lock()
+	l.finished = true
+	l.mu.Unlock()
+
+	if DefaultOptions.OnResponse != nil {
+		defer DefaultOptions.OnResponse(l.request, status, bytes, elapsed)
+	}
+
+	if status >= 500 && DefaultOptions.OnServerError != nil {
+		DefaultOptions.OnServerError(l.request.Context(), status)
+	}
+
+	// Routing happens after the middleware runs, so route patterns can
+	// only suppress the response log, and the request log when it is held
+	// back by LogOnlyErrors.
+	if len(DefaultOptions.SkipRoutePatterns) > 0 && slices.Contains(DefaultOptions.SkipRoutePatterns, routePattern(l.request)) {
+		return
+	}
+
+	if DefaultOptions.LogOnlyErrors {
+		if status < 400 && !l.panicked {
+			return
+		}
+		if l.pendingRequestLog != nil {
+			l.pendingRequestLog()
+		}
+	}
+
+	msg := responseMsg(status)
 	if l.msg != "" {
 		msg = fmt.Sprintf("%s - %s", msg, l.msg)
 	}
 
-	responseLog := map[string]interface{}{
-		"status":  status,
-		"bytes":   bytes,
-		"elapsed": float64(elapsed.Nanoseconds()) / 1000000.0, // in milliseconds
+	level := statusLevel(status)
+
+	// A recovered panic is logged at PanicLevel, even if the handler
+	// already wrote a successful status before panicking. Any error fields
+	// set by the handler are kept alongside the panic fields.
+	if l.panicked {
+		level = parseLevel(DefaultOptions.PanicLevel)
+	}
+
+	// A client that went away before a response was written is not a
+	// server problem.
+	disconnected := errors.Is(l.request.Context().Err(), context.Canceled)
+	if disconnected && status <= 0 {
+		level = slog.LevelInfo
 	}
 
-	if !DefaultOptions.Concise {
-		if status >= 400 {
-			body, _ := extra.([]byte)
-			responseLog["body"] = string(body)
+	// Status and bytes are meaningless for hijacked, upgraded connections.
+	upgrade := upgradeProtocol(l.request)
+	if upgrade != "" && status <= 0 {
+		level = slog.LevelInfo
+	}
+
+	logger := l.Logger
+	if l.err != nil {
+		logger = logger.With(slog.String("error", l.err.Error()))
+	}
+	if len(l.errorFields) > 0 && (status >= 400 || l.panicked) {
+		logger = slog.New(logger.Handler().WithAttrs(l.errorFields))
+	}
+
+	if DefaultOptions.AccessLogFormat != "" || DefaultOptions.Format == FormatW3C {
+		line := accessLogLine{request: l.request, status: status, bytes: bytes, start: now().Add(-elapsed), elapsed: elapsed}
+		logger.LogAttrs(context.Background(), level, msg, slog.Any(accessLogKey, line))
+		return
+	}
+
+	if DefaultOptions.Format == FormatDatadog {
+		logger.LogAttrs(context.Background(), level, msg, datadogResponseAttrs(l.request, status, elapsed, level)...)
+		return
+	}
+
+	responseLog := make([]slog.Attr, 0, 8)
+	responseLog = append(responseLog,
+		slog.Int("status", status),
+		slog.Int("bytes", bytes),
+		elapsedAttr(elapsed),
+	)
+	if DefaultOptions.LatencyBuckets {
+		responseLog = append(responseLog, slog.String("latencyBucket", latencyBucket(elapsed)))
+	}
+
+	verbose := l.verbose || !isConcise(l.request.Context())
+	// Without a captured body, e.g. for upgraded connections, there is
+	// nothing to log.
+	if body, _ := extra.([]byte); body != nil && status >= 400 && (verbose || DefaultOptions.LogResponseBody) && !DefaultOptions.OmitResponseBody {
+		responseLog = append(responseLog, slog.String("body", responseBodyField(header, body, bytes)))
+	}
+	if len(header) > 0 && (verbose || DefaultOptions.LogResponseHeaders) && !DefaultOptions.OmitResponseHeaders {
+		responseLog = append(responseLog, groupAttr("header", limitHeaderFields(responseHeaderLogField(header))))
+	}
+
+	if status >= 300 && status < 400 {
+		if location := header.Get("Location"); location != "" {
+			responseLog = append(responseLog, slog.String("location", location))
 		}
-		if len(header) > 0 {
-			responseLog["header"] = headerLogField(header)
+	}
+
+	if DefaultOptions.LogResponseContentType {
+		if contentType := header.Get("Content-Type"); contentType != "" {
+			responseLog = append(responseLog, slog.String("contentType", contentType))
 		}
 	}
 
-	switch statusLevel(status) {
-	case slog.LevelError:
-		l.Logger.With("httpResponse", responseLog).Error(msg)
-	case slog.LevelWarn:
-		l.Logger.With("httpResponse", responseLog).Warn(msg)
-	case slog.LevelInfo:
-	default:
-		l.Logger.With("httpResponse", responseLog).Info(msg)
+	if DefaultOptions.CacheStatusHeader != "" {
+		if cacheStatus := header.Get(DefaultOptions.CacheStatusHeader); cacheStatus != "" {
+			responseLog = append(responseLog, slog.String("cacheStatus", cacheStatus))
+		}
 	}
+
+	if DefaultOptions.LogResponseContentEncoding {
+		if contentEncoding := header.Get("Content-Encoding"); contentEncoding != "" {
+			responseLog = append(responseLog, slog.String("contentEncoding", contentEncoding))
+		}
+	}
+
+	if upgrade != "" {
+		responseLog = append(responseLog, slog.String("upgrade", upgrade))
+	}
+
+	if disconnected {
+		responseLog = append(responseLog, slog.Bool("clientDisconnected", true))
+	}
+
+	if l.panicked {
+		responseLog = append(responseLog, slog.Bool("panicked", true))
+	}
+
+	if l.timedOut {
+		responseLog = append(responseLog, slog.Bool("timedOut", true))
+		level = slog.LevelWarn
+	}
+
+	// A handler running past the request deadline often swallows the
+	// error, so flag it separately from a merely slow response.
+	if errors.Is(l.request.Context().Err(), context.DeadlineExceeded) {
+		responseLog = append(responseLog, slog.Bool("deadlineExceeded", true))
+		if level < slog.LevelWarn {
+			level = slog.LevelWarn
+		}
+	}
+
+	if DefaultOptions.LogURLParams {
+		if params := urlParamFields(l.request); len(params) > 0 {
+			responseLog = append(responseLog, groupAttr("params", params))
+		}
+	}
+
+	if contentLengthMismatch(l.request, status, bytes, header) {
+		responseLog = append(responseLog, slog.Bool("contentLengthMismatch", true))
+		if level < slog.LevelWarn {
+			level = slog.LevelWarn
+		}
+	}
+
+	if DefaultOptions.LargeResponseThreshold > 0 && bytes > DefaultOptions.LargeResponseThreshold {
+		responseLog = append(responseLog, slog.Bool("largeResponse", true))
+		if level < slog.LevelWarn {
+			level = slog.LevelWarn
+		}
+	}
+
+	attrs := httpFields("httpResponse", responseLog)
+	if DefaultOptions.FieldGroup != "" {
+		concise := (!l.verbose && isConcise(l.request.Context())) || !DefaultOptions.UnifiedEntry
+		requestAttrs := httpFields("httpRequest", requestLogFields(l.request, concise))
+		attrs = []slog.Attr{groupAttr(DefaultOptions.FieldGroup, append(requestAttrs, attrs...))}
+	}
+
+	if DefaultOptions.CoalesceWindow > 0 && l.coalescer != nil {
+		key := fmt.Sprintf("%s %s %s %s %s", level, msg, l.request.Method, l.request.URL.Path, l.err)
+		l.coalescer.log(key, DefaultOptions.CoalesceWindow, func(repeated int) {
+			if repeated > 0 {
+				attrs = append(attrs, slog.Int("repeated", repeated))
+			}
+			logger.LogAttrs(context.Background(), level, msg, attrs...)
+		})
+		return
+	}
+
+	logger.LogAttrs(context.Background(), level, msg, attrs...)
 }
 
+// Panic attaches the recovered value and stacktrace to the entry as
+// structured fields, so they are emitted on the Error level response log
+// line instead of being printed to stdout.
 func (l *RequestLoggerEntry) Panic(v interface{}, stack []byte) {
-	stacktrace := "#"
-	stacktrace = string(stack)
+	l.update(func() {
+		l.Logger = l.Logger.With(
+			slog.String("stacktrace", string(stack)),
+			slog.String("panic", fmt.Sprintf("%+v", v)),
+			slog.String("errorType", fmt.Sprintf("%T", v)),
+		)
 
-	l.Logger = l.Logger.
-		With("stacktrace", stacktrace).
-		With("panic", fmt.Sprintf("%+v", v))
+		l.msg = fmt.Sprintf("%+v", v)
+		l.panicked = true
+	})
 
-	l.msg = fmt.Sprintf("%+v", v)
+	if DefaultOptions.OnPanic != nil {
+		DefaultOptions.OnPanic(l.request.Context(), v, stack)
+	}
 
-	middleware.PrintPrettyStack(v)
+	if DefaultOptions.PrintPrettyStack {
+		middleware.PrintPrettyStack(v)
+	}
 }
 
-func requestLogFields(r *http.Request, concise bool) map[string]interface{} {
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+// isConcise reports whether headers and bodies are left out of the logs.
+// They are always included while the configured LogLevel (see SetLevel)
+// is Debug or when the request was marked with ForceVerbose. Loggers
+// enabling Debug on their own, such as NewTestLogger or PathLevels, keep
+// the Concise setting.
+func isConcise(ctx context.Context) bool {
+	if verbose, _ := ctx.Value(forceVerboseCtxKey).(bool); verbose {
+		return false
 	}
-	requestURL := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.RequestURI)
+	return DefaultOptions.Concise && levelVar.Level() > slog.LevelDebug
+}
 
-	requestFields := map[string]interface{}{
-		"requestURL":    requestURL,
-		"requestMethod": r.Method,
-		"requestPath":   r.URL.Path,
-		"remoteIP":      r.RemoteAddr,
-		"proto":         r.Proto,
+func elapsedAttr(elapsed time.Duration) slog.Attr {
+	switch DefaultOptions.ElapsedUnit {
+	case "ns":
+		return slog.Int64(DefaultOptions.ElapsedFieldName, elapsed.Nanoseconds())
+	case "s":
+		return slog.Float64(DefaultOptions.ElapsedFieldName, elapsed.Seconds())
+	default:
+		return slog.Float64(DefaultOptions.ElapsedFieldName, float64(elapsed.Nanoseconds())/1000000.0) // in milliseconds
 	}
-	if reqID := middleware.GetReqID(r.Context()); reqID != "" {
-		requestFields["requestID"] = reqID
+}
+
+// defaultLatencyBuckets are the LatencyBucketBounds used when none are
+// configured.
+var defaultLatencyBuckets = []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+
+// latencyBucket labels elapsed with the bucket it falls in, e.g. "<10ms",
+// "10ms-100ms" or ">=1s". Each bucket includes its lower bound.
+func latencyBucket(elapsed time.Duration) string {
+	bounds := DefaultOptions.LatencyBucketBounds
+	if len(bounds) == 0 {
+		bounds = defaultLatencyBuckets
+	}
+
+	for i, bound := range bounds {
+		if elapsed < bound {
+			if i == 0 {
+				return "<" + bound.String()
+			}
+			return bounds[i-1].String() + "-" + bound.String()
+		}
+	}
+	return ">=" + bounds[len(bounds)-1].String()
+}
+
+func requestMsg(r *http.Request) string {
+	if DefaultOptions.RequestMsgFunc != nil {
+		return DefaultOptions.RequestMsgFunc(r)
 	}
+	return fmt.Sprintf("Request: %s %s", r.Method, r.URL.Path)
+}
+
+func responseMsg(status int) string {
+	if DefaultOptions.ResponseMsgFunc != nil {
+		return DefaultOptions.ResponseMsgFunc(status)
+	}
+	return fmt.Sprintf("Response: %d %s", status, statusLabel(status))
+}
 
-	if concise {
-		return requestFields
+func requestLogFields(r *http.Request, concise bool) []slog.Attr {
+	requestFields := make([]slog.Attr, 0, 12)
+	requestFields = append(requestFields,
+		slog.String("requestURL", requestURL(r)),
+		slog.String("requestMethod", r.Method),
+		slog.String("requestPath", r.URL.Path),
+		slog.String("remoteIP", remoteIP(r)),
+	)
+
+	if DefaultOptions.LogHost && r.Host != "" {
+		requestFields = append(requestFields, slog.String("host", r.Host))
+	}
+
+	if DefaultOptions.LogQuery && r.URL.RawQuery != "" {
+		requestFields = append(requestFields, slog.String("query", redactRawQuery(r.URL.RawQuery)))
+	}
+	if DefaultOptions.LogQueryParams && r.URL.RawQuery != "" {
+		requestFields = append(requestFields, groupAttr("queryParams", queryLogField(r.URL.Query())))
 	}
 
-	requestFields["scheme"] = scheme
+	if DefaultOptions.SemConv {
+		requestFields = append(requestFields, slog.String("proto", fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)))
+	} else {
+		requestFields = append(requestFields, slog.String("proto", r.Proto))
+	}
+
+	if DefaultOptions.LogHTTP2 {
+		requestFields = append(requestFields, slog.Bool("http2", r.ProtoMajor == 2))
+	}
+	if reqID := RequestID(r.Context()); reqID != "" {
+		requestFields = append(requestFields, slog.String(DefaultOptions.RequestIDFieldName, reqID))
+	}
+	if r.ContentLength > 0 {
+		requestFields = append(requestFields, slog.Int64("bytesIn", r.ContentLength))
+	}
+	if n, ok := r.Context().Value(inFlightCtxKey).(int64); ok {
+		requestFields = append(requestFields, slog.Int64("inFlight", n))
+	}
+	if bodyHash, ok := r.Context().Value(bodyHashCtxKey).(string); ok {
+		requestFields = append(requestFields, slog.String("bodyHash", bodyHash))
+	}
+	if tooLarge, _ := r.Context().Value(bodyTooLargeCtxKey).(bool); tooLarge {
+		requestFields = append(requestFields, slog.Bool("bodyTooLarge", true))
+	}
+	if DefaultOptions.Fingerprint {
+		requestFields = append(requestFields, slog.String("requestFingerprint", requestFingerprint(r)))
+	}
+
+	if DefaultOptions.LogUserAgent || DefaultOptions.SemConv {
+		if ua := r.UserAgent(); ua != "" {
+			requestFields = append(requestFields, slog.String("userAgent", ua))
+		}
+	}
+	if DefaultOptions.LogTLS && r.TLS != nil {
+		requestFields = append(requestFields,
+			slog.String("tlsVersion", tls.VersionName(r.TLS.Version)),
+			slog.String("tlsCipher", tls.CipherSuiteName(r.TLS.CipherSuite)),
+		)
+		if r.TLS.ServerName != "" {
+			requestFields = append(requestFields, slog.String("tlsServerName", r.TLS.ServerName))
+		}
+	}
+	if DefaultOptions.LogReferer {
+		if referer := r.Referer(); referer != "" {
+			requestFields = append(requestFields, slog.String("referer", referer))
+		}
+	}
 
-	if len(r.Header) > 0 {
-		requestFields["header"] = headerLogField(r.Header)
+	if !concise || DefaultOptions.SemConv {
+		requestFields = append(requestFields, slog.String("scheme", requestScheme(r)))
+	}
+
+	if !concise && len(r.Header) > 0 {
+		requestFields = append(requestFields, groupAttr("header", limitHeaderFields(headerLogField(r.Header))))
 	}
 
 	return requestFields
 }
 
-func headerLogField(header http.Header) map[string]string {
-	headerField := map[string]string{}
-	for k, v := range header {
-		k = strings.ToLower(k)
-		switch {
-		case len(v) == 0:
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		return rctx.RoutePattern()
+	}
+	return ""
+}
+
+// urlParamFields returns the chi URL parameters matched for r.
+func urlParamFields(r *http.Request) []slog.Attr {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return nil
+	}
+
+	params := make([]slog.Attr, 0, len(rctx.URLParams.Keys))
+	for i, key := range rctx.URLParams.Keys {
+		if key == "" || i >= len(rctx.URLParams.Values) {
+			continue
+		}
+		params = append(params, slog.String(key, rctx.URLParams.Values[i]))
+	}
+	return params
+}
+
+func requestScheme(r *http.Request) string {
+	if DefaultOptions.ForwardedSchemeHeader != "" {
+		// Proxies may append to the header; the first value is the
+		// client-facing one.
+		scheme, _, _ := strings.Cut(r.Header.Get(DefaultOptions.ForwardedSchemeHeader), ",")
+		if scheme = strings.TrimSpace(scheme); scheme != "" {
+			return strings.ToLower(scheme)
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func requestURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host + requestURI(r)
+}
+
+// requestURI returns r.RequestURI with the RedactQueryParams values in
+// its query masked.
+func requestURI(r *http.Request) string {
+	path, query, ok := strings.Cut(r.RequestURI, "?")
+	if !ok {
+		return r.RequestURI
+	}
+	return path + "?" + redactRawQuery(query)
+}
+
+// redactRawQuery masks the RedactQueryParams values in a raw query
+// string, leaving the order and encoding of the other parameters as is.
+func redactRawQuery(query string) string {
+	if len(DefaultOptions.RedactQueryParams) == 0 || query == "" {
+		return query
+	}
+
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		k, v, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil || !slices.Contains(DefaultOptions.RedactQueryParams, key) {
 			continue
-		case len(v) == 1:
-			headerField[k] = v[0]
-		default:
-			headerField[k] = fmt.Sprintf("[%s]", strings.Join(v, "], ["))
 		}
-		if k == "authorization" || k == "cookie" || k == "set-cookie" {
-			headerField[k] = "***"
+		value, _ := url.QueryUnescape(v)
+		// Asterisks are valid in a query, so the default placeholder is
+		// kept readable.
+		params[i] = k + "=" + strings.ReplaceAll(url.QueryEscape(redactValue(key, value)), "%2A", "*")
+	}
+	return strings.Join(params, "&")
+}
+
+func headerLogField(header http.Header) []slog.Attr {
+	headerField := make([]slog.Attr, 0, len(header))
+	for k, v := range header {
+		if len(v) == 0 {
+			continue
 		}
 
-		for _, skip := range DefaultOptions.SkipHeaders {
-			if k == skip {
-				headerField[k] = "***"
-				break
+		k = strings.ToLower(k)
+		value := v[0]
+		if len(v) > 1 {
+			if DefaultOptions.SortHeaderValues {
+				v = slices.Clone(v)
+				slices.Sort(v)
 			}
+			value = "[" + strings.Join(v, "], [") + "]"
+		}
+		if redactedHeader(k) {
+			value = redactValue(k, value)
+		} else if limit := DefaultOptions.MaxHeaderValueLen; limit > 0 && len(value) > limit {
+			value = value[:limit] + "..."
 		}
+		headerField = append(headerField, slog.String(k, value))
 	}
+
+	// Keep the output stable, as map iteration order is random.
+	slices.SortFunc(headerField, func(a, b slog.Attr) int {
+		return strings.Compare(a.Key, b.Key)
+	})
 	return headerField
 }
 
+// queryLogField renders query parameters like headerLogField does,
+// masking those listed in RedactQueryParams.
+func queryLogField(query url.Values) []slog.Attr {
+	queryField := make([]slog.Attr, 0, len(query))
+	for k, v := range query {
+		if len(v) == 0 {
+			continue
+		}
+
+		value := v[0]
+		if len(v) > 1 {
+			value = "[" + strings.Join(v, "], [") + "]"
+		}
+		if slices.Contains(DefaultOptions.RedactQueryParams, k) {
+			value = redactValue(k, value)
+		}
+		queryField = append(queryField, slog.String(k, value))
+	}
+
+	slices.SortFunc(queryField, func(a, b slog.Attr) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return queryField
+}
+
+// responseHeaderLogField is headerLogField restricted to the
+// ResponseHeaders allowlist. An empty allowlist logs all headers.
+func responseHeaderLogField(header http.Header) []slog.Attr {
+	headerField := headerLogField(header)
+	if len(DefaultOptions.ResponseHeaders) == 0 {
+		return headerField
+	}
+
+	allowed := headerField[:0]
+	for _, attr := range headerField {
+		if slices.Contains(DefaultOptions.ResponseHeaders, attr.Key) {
+			allowed = append(allowed, attr)
+		}
+	}
+	return allowed
+}
+
+// limitHeaderFields keeps at most MaxHeadersLogged header fields, adding
+// an "omitted" count for the rest.
+func limitHeaderFields(headerField []slog.Attr) []slog.Attr {
+	limit := DefaultOptions.MaxHeadersLogged
+	if limit <= 0 || len(headerField) <= limit {
+		return headerField
+	}
+	omitted := len(headerField) - limit
+	return append(headerField[:limit], slog.Int("omitted", omitted))
+}
+
+// defaultRedactHeaders are always masked unless DisableDefaultRedaction
+// is set.
+var defaultRedactHeaders = []string{"authorization", "cookie", "set-cookie", "x-api-key", "x-auth-token"}
+
+func redactedHeader(k string) bool {
+	if !DefaultOptions.DisableDefaultRedaction && slices.Contains(defaultRedactHeaders, k) {
+		return true
+	}
+	return slices.Contains(DefaultOptions.RedactHeaders, k) || slices.Contains(DefaultOptions.SkipHeaders, k)
+}
+
+// redactValue masks a sensitive value, delegating to the configured
+// FieldEncryptor when one is set.
+func redactValue(field, value string) string {
+	if DefaultOptions.FieldEncryptor != nil {
+		return DefaultOptions.FieldEncryptor(field, value)
+	}
+	return DefaultOptions.RedactPlaceholder
+}
+
 func statusLevel(status int) slog.Level {
+	if DefaultOptions.StatusLevelFunc != nil {
+		return DefaultOptions.StatusLevelFunc(status)
+	}
+
 	switch {
 	case status <= 0:
 		return slog.LevelWarn
@@ -217,6 +887,10 @@ func statusLevel(status int) slog.Level {
 }
 
 func statusLabel(status int) string {
+	if DefaultOptions.StatusLabelFunc != nil {
+		return DefaultOptions.StatusLabelFunc(status)
+	}
+
 	switch {
 	case status >= 100 && status < 300:
 		return "OK"
@@ -231,23 +905,158 @@ func statusLabel(status int) string {
 	}
 }
 
+// RequestID returns the ID of the request, as logged in the requestID
+// field, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	return middleware.GetReqID(ctx)
+}
+
+// GetLogEntry returns the entry stored by Handler. It is looked up under
+// this package's own context key first, so another chi-based logger
+// installed alongside doesn't shadow it, then under chi's LogEntryCtxKey.
+func GetLogEntry(ctx context.Context) (*RequestLoggerEntry, bool) {
+	entry, ok := ctx.Value(logEntryCtxKey).(*RequestLoggerEntry)
+	if !ok {
+		entry, ok = ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry)
+	}
+	return entry, ok && entry != nil
+}
+
 func LogEntry(ctx context.Context) *slog.Logger {
-	entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry)
-	if !ok || entry == nil {
+	entry, ok := GetLogEntry(ctx)
+	if !ok {
 		return slog.Default()
 	} else {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
 		return entry.Logger
 	}
 }
 
+// LogEntryWith returns a child of the request logger with args added,
+// leaving the entry and its response log line untouched.
+func LogEntryWith(ctx context.Context, args ...any) *slog.Logger {
+	return LogEntry(ctx).With(args...)
+}
+
 func LogEntrySetField(ctx context.Context, key, value string) {
-	if entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry); ok {
-		entry.Logger = entry.Logger.With(key, value)
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			entry.with(slog.String(key, value))
+		})
 	}
 }
 
 func LogEntrySetFields(ctx context.Context, fields map[string]interface{}) {
-	if entry, ok := ctx.Value(middleware.LogEntryCtxKey).(*RequestLoggerEntry); ok {
-		entry.Logger = entry.Logger.With(fields)
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			for k, v := range fields {
+				entry.with(slog.Any(k, v))
+			}
+		})
+	}
+}
+
+// LogEntrySetErrorField sets a field that is only logged on the response
+// line if the request ends with a status of 400 or above, or panics.
+func LogEntrySetErrorField(ctx context.Context, key, value string) {
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			entry.errorFields = append(entry.errorFields, slog.String(key, value))
+		})
+	}
+}
+
+// LogEntrySetErrorFields is LogEntrySetErrorField for several fields.
+func LogEntrySetErrorFields(ctx context.Context, fields map[string]interface{}) {
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			for k, v := range fields {
+				entry.errorFields = append(entry.errorFields, slog.Any(k, v))
+			}
+		})
+	}
+}
+
+// LogEntrySetGroup attaches fields nested under groupName, e.g.
+// {"user": {"id": ..., "role": ...}}.
+func LogEntrySetGroup(ctx context.Context, groupName string, fields map[string]interface{}) {
+	if entry, ok := GetLogEntry(ctx); ok {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		attrs := make([]slog.Attr, 0, len(fields))
+		for _, k := range keys {
+			attrs = append(attrs, slog.Any(k, fields[k]))
+		}
+		entry.update(func() {
+			entry.with(groupAttr(groupName, attrs))
+		})
+	}
+}
+
+// LogEntryRemoveField drops a field previously set with LogEntrySetField,
+// LogEntrySetFields or LogEntrySetGroup from the request's logger.
+func LogEntryRemoveField(ctx context.Context, key string) {
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			if entry.base == nil {
+				return
+			}
+			fields := entry.fields[:0]
+			for _, attr := range entry.fields {
+				if attr.Key != key {
+					fields = append(fields, attr)
+				}
+			}
+			entry.fields = fields
+			entry.Logger = slog.New(entry.base.Handler().WithAttrs(fields))
+		})
+	}
+}
+
+// LogEntrySetMessage appends msg to the request's response log message.
+func LogEntrySetMessage(ctx context.Context, msg string) {
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			entry.msg = msg
+		})
+	}
+}
+
+// LogEntrySetError attaches err to the request's response log line as
+// an "error" field.
+func LogEntrySetError(ctx context.Context, err error) {
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			entry.err = err
+		})
+	}
+}
+
+// DisableBodyCapture stops the response body of the current request from
+// being captured for logging, e.g. for streaming endpoints. It must be
+// called before the handler starts writing the body.
+func DisableBodyCapture(ctx context.Context) {
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			entry.noBodyCapture = true
+		})
+	}
+}
+
+// ForceVerbose marks the request for full logging of headers and bodies,
+// overriding Concise. Called from a handler, it affects the response log;
+// middleware running before the logger should use the returned context
+// so that the request log is verbose and the response body is captured.
+func ForceVerbose(ctx context.Context) context.Context {
+	if entry, ok := GetLogEntry(ctx); ok {
+		entry.update(func() {
+			entry.verbose = true
+		})
 	}
+	return context.WithValue(ctx, forceVerboseCtxKey, true)
 }
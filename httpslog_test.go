@@ -0,0 +1,1879 @@
+package httpslog
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+func statusHandler(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}
+}
+
+// testLogger configures the package with opts, logging to the returned
+// buffer, and restores the defaults when the test ends.
+func testLogger(t *testing.T, opts Options) (*slog.Logger, *bytes.Buffer) {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	opts.Writers = append(opts.Writers, buf)
+	if opts.Hostname == "" {
+		opts.Hostname = "test-host"
+	}
+	logger := NewLogger("test", opts)
+	t.Cleanup(func() { Configure(Options{}) })
+	return logger, buf
+}
+
+// serve sends req through Handler(logger) to h.
+func serve(logger *slog.Logger, h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	Handler(logger)(h).ServeHTTP(rec, req)
+	return rec
+}
+
+// logLines decodes the JSON log lines written to buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("decoding log line: %v\n%s", err, buf)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// lastLine returns the last JSON log line written to buf, which is the
+// response line after a request.
+func lastLine(t *testing.T, buf *bytes.Buffer) map[string]any {
+	t.Helper()
+
+	lines := logLines(t, buf)
+	if len(lines) == 0 {
+		t.Fatal("no log line written")
+	}
+	return lines[len(lines)-1]
+}
+
+// field returns the value at the path of nested keys in line, or nil.
+func field(line map[string]any, path ...string) any {
+	var v any = line
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func TestUnifiedEntry(t *testing.T) {
+	for _, concise := range []bool{false, true} {
+		logger, buf := testLogger(t, Options{UnifiedEntry: true, Concise: concise})
+		serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+		serve(logger, okHandler, httptest.NewRequest("GET", "/orders", nil))
+
+		lines := logLines(t, buf)
+		if len(lines) != 2 {
+			t.Fatalf("concise=%v: got %d lines for 2 requests, want 2:\n%s", concise, len(lines), buf)
+		}
+		for i, path := range []string{"/users", "/orders"} {
+			if got := field(lines[i], "httpRequest", "requestPath"); got != path {
+				t.Errorf("concise=%v: httpRequest.requestPath = %v, want %s", concise, got, path)
+			}
+			if got := field(lines[i], "httpResponse", "status"); got != float64(http.StatusOK) {
+				t.Errorf("concise=%v: httpResponse.status = %v, want 200", concise, got)
+			}
+		}
+	}
+}
+
+func TestUnifiedEntryFieldGroup(t *testing.T) {
+	logger, buf := testLogger(t, Options{UnifiedEntry: true, FieldGroup: "http"})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1:\n%s", len(lines), buf)
+	}
+	if field(lines[0], "http", "httpRequest", "requestPath") != "/users" || field(lines[0], "http", "httpResponse", "status") != float64(200) {
+		t.Errorf("request and response groups not nested under http:\n%s", buf)
+	}
+}
+
+func TestMessageFuncs(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		RequestMsgFunc: func(r *http.Request) string {
+			return "started " + r.Method + " " + r.URL.Path
+		},
+		ResponseMsgFunc: func(status int) string {
+			return "finished " + http.StatusText(status)
+		},
+	})
+	serve(logger, statusHandler(http.StatusNotFound), httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf)
+	}
+	if got := lines[0]["msg"]; got != "started GET /users" {
+		t.Errorf("request msg = %q, want %q", got, "started GET /users")
+	}
+	if got := lines[1]["msg"]; got != "finished Not Found" {
+		t.Errorf("response msg = %q, want %q", got, "finished Not Found")
+	}
+}
+
+func TestDefaultMessages(t *testing.T) {
+	logger, buf := testLogger(t, Options{})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf)
+	}
+	if got := lines[0]["msg"]; got != "Request: GET /users" {
+		t.Errorf("request msg = %q", got)
+	}
+	if got := lines[1]["msg"]; got != "Response: 200 OK" {
+		t.Errorf("response msg = %q", got)
+	}
+}
+
+func TestFieldEncryptor(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		LogQueryParams:    true,
+		RedactQueryParams: []string{"token"},
+		FieldEncryptor: func(field, value string) string {
+			return "enc(" + field + ":" + value + ")"
+		},
+	})
+	req := httptest.NewRequest("GET", "/users?token=s3cr3t&page=2", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	serve(logger, okHandler, req)
+
+	line := logLines(t, buf)[0]
+	if got := field(line, "httpRequest", "header", "authorization"); got != "enc(authorization:Bearer abc)" {
+		t.Errorf("authorization header = %v", got)
+	}
+	if got := field(line, "httpRequest", "queryParams", "token"); got != "enc(token:s3cr3t)" {
+		t.Errorf("token query param = %v", got)
+	}
+	if got := field(line, "httpRequest", "queryParams", "page"); got != "2" {
+		t.Errorf("page query param = %v, want 2", got)
+	}
+}
+
+func TestRedactionDefault(t *testing.T) {
+	logger, buf := testLogger(t, Options{})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	serve(logger, okHandler, req)
+
+	if got := field(logLines(t, buf)[0], "httpRequest", "header", "authorization"); got != "***" {
+		t.Errorf("authorization header = %v, want ***", got)
+	}
+}
+
+func TestLargeResponseThreshold(t *testing.T) {
+	logger, buf := testLogger(t, Options{LargeResponseThreshold: 1})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if got := field(line, "httpResponse", "largeResponse"); got != true {
+		t.Errorf("largeResponse = %v, want true", got)
+	}
+	if got := line["level"]; got != "WARN" {
+		t.Errorf("level = %v, want WARN", got)
+	}
+
+	buf.Reset()
+	serve(logger, statusHandler(http.StatusNoContent), httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "largeResponse"); got != nil {
+		t.Errorf("largeResponse = %v for an empty response", got)
+	}
+}
+
+func TestPanicWithError(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogEntrySetError(r.Context(), errors.New("db: connection refused"))
+		w.WriteHeader(http.StatusOK)
+		panic("boom")
+	})
+	serve(logger, middleware.Recoverer(h), httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if got := line["level"]; got != "ERROR" {
+		t.Errorf("level = %v, want ERROR for a panic after a 200", got)
+	}
+	if got := line["error"]; got != "db: connection refused" {
+		t.Errorf("error = %v, want the handler error", got)
+	}
+	if got := line["panic"]; got != "boom" {
+		t.Errorf("panic = %v, want boom", got)
+	}
+	if got := field(line, "httpResponse", "panicked"); got != true {
+		t.Errorf("httpResponse.panicked = %v, want true", got)
+	}
+}
+
+func TestOnResponse(t *testing.T) {
+	var calls int
+	var gotStatus, gotBytes int
+	var gotElapsed time.Duration
+	logger, _ := testLogger(t, Options{
+		OnResponse: func(r *http.Request, status, bytes int, elapsed time.Duration) {
+			calls++
+			gotStatus, gotBytes, gotElapsed = status, bytes, elapsed
+		},
+	})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	serve(logger, h, httptest.NewRequest("POST", "/users", nil))
+
+	if calls != 1 {
+		t.Fatalf("OnResponse called %d times, want 1", calls)
+	}
+	if gotStatus != http.StatusCreated || gotBytes != len("created") {
+		t.Errorf("OnResponse got status %d and %d bytes, want 201 and %d", gotStatus, gotBytes, len("created"))
+	}
+	if gotElapsed <= 0 {
+		t.Errorf("OnResponse got elapsed %v, want > 0", gotElapsed)
+	}
+
+	Handler(logger, []string{"/health"})(okHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	if calls != 1 {
+		t.Errorf("OnResponse called for a skipped path")
+	}
+}
+
+func BenchmarkHandler(b *testing.B) {
+	logger := NewLogger("bench", Options{Writers: []io.Writer{io.Discard}})
+	b.Cleanup(func() { Configure(Options{}) })
+	h := Handler(logger)(okHandler)
+	req := httptest.NewRequest("GET", "/users?page=2", nil)
+	req.Header.Set("User-Agent", "bench")
+	req.Header.Set("Accept", "application/json")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// BenchmarkBodyCapture compares Concise mode, which skips the body tee,
+// against the same configuration capturing bodies for error responses.
+func BenchmarkBodyCapture(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		opts Options
+	}{
+		{"off", Options{Concise: true}},
+		{"on", Options{Concise: true, LogResponseBody: true}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			bb.opts.Writers = []io.Writer{io.Discard}
+			logger := NewLogger("bench", bb.opts)
+			b.Cleanup(func() { Configure(Options{}) })
+			h := Handler(logger)(okHandler)
+			req := httptest.NewRequest("GET", "/users", nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	logger, buf := testLogger(t, Options{ResponseHeaders: []string{"Content-Type", "x-request-id"}})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Request-Id", "abc")
+		w.Header().Set("X-Internal-Host", "db-1")
+		w.Write([]byte("ok"))
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	header, _ := field(lastLine(t, buf), "httpResponse", "header").(map[string]any)
+	if len(header) != 2 || header["content-type"] != "text/plain" || header["x-request-id"] != "abc" {
+		t.Errorf("httpResponse.header = %v, want only content-type and x-request-id", header)
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	logger, buf := testLogger(t, Options{RedactHeaders: []string{"X-Tenant-Secret"}})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-Tenant-Secret", "s3cr3t")
+	req.Header.Set("X-Api-Key", "key")
+	req.Header.Set("Accept", "text/plain")
+	serve(logger, okHandler, req)
+
+	header, _ := field(logLines(t, buf)[0], "httpRequest", "header").(map[string]any)
+	if header["x-tenant-secret"] != "***" || header["x-api-key"] != "***" {
+		t.Errorf("custom and built-in headers not masked: %v", header)
+	}
+	if header["accept"] != "text/plain" {
+		t.Errorf("accept = %v, want text/plain", header["accept"])
+	}
+}
+
+func TestDisableDefaultRedaction(t *testing.T) {
+	logger, buf := testLogger(t, Options{DisableDefaultRedaction: true, RedactHeaders: []string{"x-api-key"}})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("X-Api-Key", "key")
+	serve(logger, okHandler, req)
+
+	header, _ := field(logLines(t, buf)[0], "httpRequest", "header").(map[string]any)
+	if header["authorization"] != "Bearer abc" {
+		t.Errorf("authorization = %v, want it unmasked", header["authorization"])
+	}
+	if header["x-api-key"] != "***" {
+		t.Errorf("x-api-key = %v, want it masked by RedactHeaders", header["x-api-key"])
+	}
+}
+
+func TestPanicStructured(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(errors.New("boom"))
+	})
+	serve(logger, middleware.Recoverer(h), httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want a single JSON line:\n%s", len(lines), buf)
+	}
+	line := lines[0]
+	if line["level"] != "ERROR" {
+		t.Errorf("level = %v, want ERROR", line["level"])
+	}
+	if line["panic"] != "boom" || line["errorType"] != "*errors.errorString" {
+		t.Errorf("panic, errorType = %v, %v", line["panic"], line["errorType"])
+	}
+	if stack, _ := line["stacktrace"].(string); stack == "" {
+		t.Error("stacktrace missing")
+	}
+	if got := field(line, "httpResponse", "status"); got != float64(http.StatusInternalServerError) {
+		t.Errorf("httpResponse.status = %v, want 500", got)
+	}
+}
+
+func TestPanicLevel(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, PanicLevel: "warn"})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	RequestLogger(logger)(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if line["level"] != "WARN" || line["panic"] != "boom" {
+		t.Errorf("level, panic = %v, %v, want WARN, boom", line["level"], line["panic"])
+	}
+}
+
+func TestLogEntrySetError(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogEntrySetError(r.Context(), errors.New("user not found"))
+		w.WriteHeader(http.StatusNotFound)
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users/1", nil))
+
+	if got := lastLine(t, buf)["error"]; got != "user not found" {
+		t.Errorf("error = %v, want %q", got, "user not found")
+	}
+}
+
+func TestRequestLoggerWith(t *testing.T) {
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	for _, cfg := range []Config{{}, {RequestID: true}, {Recoverer: true}, {RequestID: true, Recoverer: true}} {
+		logger, buf := testLogger(t, Options{Concise: true})
+		h := RequestLoggerWith(logger, cfg)(panicking)
+
+		recovered := func() (recovered bool) {
+			defer func() { recovered = recover() == nil }()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+			return
+		}()
+		if recovered != cfg.Recoverer {
+			t.Errorf("%+v: panic recovered = %v", cfg, recovered)
+		}
+
+		if !cfg.Recoverer {
+			continue
+		}
+		reqID := field(lastLine(t, buf), "httpRequest", "requestID")
+		if (reqID != nil) != cfg.RequestID {
+			t.Errorf("%+v: requestID = %v", cfg, reqID)
+		}
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, RequestIDHeader: "X-Correlation-ID"})
+	h := RequestLogger(logger)(okHandler)
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-Correlation-ID", "upstream-42")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got := field(lastLine(t, buf), "httpRequest", "requestID"); got != "upstream-42" {
+		t.Errorf("requestID = %v, want upstream-42 from the header", got)
+	}
+
+	buf.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	if got, _ := field(lastLine(t, buf), "httpRequest", "requestID").(string); got == "" || got == "upstream-42" {
+		t.Errorf("requestID = %q, want a generated ID", got)
+	}
+}
+
+func TestElapsedUnit(t *testing.T) {
+	tests := []struct {
+		unit string
+		want slog.Value
+	}{
+		{"", slog.Float64Value(1500)},
+		{"ms", slog.Float64Value(1500)},
+		{"s", slog.Float64Value(1.5)},
+		{"ns", slog.Int64Value(1_500_000_000)},
+	}
+	for _, tt := range tests {
+		testLogger(t, Options{ElapsedUnit: tt.unit})
+		if got := elapsedAttr(1500 * time.Millisecond); !got.Equal(slog.Attr{Key: "elapsed", Value: tt.want}) {
+			t.Errorf("ElapsedUnit %q: elapsedAttr(1.5s) = %v, want elapsed=%v", tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestElapsedFieldName(t *testing.T) {
+	logger, buf := testLogger(t, Options{ElapsedFieldName: "duration_ms"})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	response, _ := field(lastLine(t, buf), "httpResponse").(map[string]any)
+	if _, ok := response["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms missing: %v", response)
+	}
+	if _, ok := response["elapsed"]; ok {
+		t.Errorf("elapsed logged along duration_ms: %v", response)
+	}
+}
+
+func TestResponseBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/json", `{"error":"not found"}`, `{"error":"not found"}`},
+		{"image/png", "\x89PNG\r\n\x1a\n", "<binary 8 bytes>"},
+	}
+	for _, tt := range tests {
+		logger, buf := testLogger(t, Options{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(tt.body))
+		})
+		serve(logger, h, httptest.NewRequest("GET", "/users/1", nil))
+
+		if got := field(lastLine(t, buf), "httpResponse", "body"); got != tt.want {
+			t.Errorf("%s: body = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestClientDisconnected(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil).WithContext(ctx))
+
+	line := lastLine(t, buf)
+	if got := field(line, "httpResponse", "clientDisconnected"); got != true {
+		t.Errorf("clientDisconnected = %v, want true", got)
+	}
+	if line["level"] != "INFO" {
+		t.Errorf("level = %v, want INFO for an abandoned request", line["level"])
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	logger, buf := testLogger(t, Options{})
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("handshake failed"))
+	})
+	serve(logger, h, req)
+
+	response, _ := field(lastLine(t, buf), "httpResponse").(map[string]any)
+	if response["upgrade"] != "websocket" {
+		t.Errorf("upgrade = %v, want websocket", response["upgrade"])
+	}
+	if body, ok := response["body"]; ok {
+		t.Errorf("body = %v captured for an upgrade request", body)
+	}
+}
+
+func TestBodyCaptureSkipped(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"sse": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("data: secret\n\n"))
+			w.(http.Flusher).Flush()
+		},
+		"DisableBodyCapture": func(w http.ResponseWriter, r *http.Request) {
+			DisableBodyCapture(r.Context())
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("data: secret\n\n"))
+		},
+	}
+	for name, h := range handlers {
+		logger, buf := testLogger(t, Options{})
+		rec := serve(logger, h, httptest.NewRequest("GET", "/events", nil))
+
+		if rec.Body.String() != "data: secret\n\n" {
+			t.Errorf("%s: client got %q", name, rec.Body)
+		}
+		if strings.Contains(buf.String(), "secret") {
+			t.Errorf("%s: streamed data captured in the log:\n%s", name, buf)
+		}
+	}
+}
+
+func TestRequestHooks(t *testing.T) {
+	var calls []string
+	logger, _ := testLogger(t, Options{
+		BeforeRequest: func(ctx context.Context, r *http.Request) {
+			calls = append(calls, "before "+r.URL.Path)
+		},
+		AfterRequest: func(ctx context.Context, status int) {
+			if _, ok := GetLogEntry(ctx); !ok {
+				t.Error("AfterRequest context carries no log entry")
+			}
+			calls = append(calls, fmt.Sprintf("after %d", status))
+		},
+	})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	serve(logger, h, httptest.NewRequest("POST", "/jobs", nil))
+
+	if got, want := strings.Join(calls, ", "), "before /jobs, handler, after 202"; got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestStatusFuncs(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		Concise: true,
+		StatusLevelFunc: func(status int) slog.Level {
+			if status == http.StatusNotFound {
+				return slog.LevelInfo
+			}
+			return slog.LevelWarn
+		},
+		StatusLabelFunc: func(status int) string {
+			return "custom " + http.StatusText(status)
+		},
+	})
+	serve(logger, statusHandler(http.StatusNotFound), httptest.NewRequest("GET", "/users/1", nil))
+
+	line := lastLine(t, buf)
+	if line["level"] != "INFO" {
+		t.Errorf("level = %v, want INFO for an overridden 404", line["level"])
+	}
+	if line["msg"] != "Response: 404 custom Not Found" {
+		t.Errorf("msg = %v", line["msg"])
+	}
+}
+
+func TestSkipRoutePatterns(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, SkipRoutePatterns: []string{"/users/{id}"}})
+	r := chi.NewRouter()
+	r.Use(Handler(logger))
+	r.Get("/users/{id}", okHandler)
+	r.Get("/orders/{id}", okHandler)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/1", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want only /orders/1:\n%s", len(lines), buf)
+	}
+	if got := field(lines[0], "httpRequest", "requestPath"); got != "/orders/1" {
+		t.Errorf("requestPath = %v, want /orders/1", got)
+	}
+}
+
+func TestGetLogEntry(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := GetLogEntry(r.Context())
+		if !ok {
+			t.Fatal("GetLogEntry found no entry")
+		}
+		entry.msg = "cache miss"
+		w.WriteHeader(http.StatusOK)
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	if got := lastLine(t, buf)["msg"]; got != "Response: 200 OK - cache miss" {
+		t.Errorf("msg = %v", got)
+	}
+	if _, ok := GetLogEntry(context.Background()); ok {
+		t.Error("GetLogEntry found an entry in an empty context")
+	}
+}
+
+func TestLogEntrySetMessage(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogEntrySetMessage(r.Context(), "user not found")
+		w.WriteHeader(http.StatusNotFound)
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users/1", nil))
+
+	if got := lastLine(t, buf)["msg"]; got != "Response: 404 Client Error - user not found" {
+		t.Errorf("msg = %v", got)
+	}
+}
+
+func TestLogUserAgentReferer(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogUserAgent: true, LogReferer: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("Referer", "https://example.com/")
+	serve(logger, okHandler, req)
+
+	line := lastLine(t, buf)
+	if got := field(line, "httpRequest", "userAgent"); got != "curl/8.0" {
+		t.Errorf("userAgent = %v, want curl/8.0", got)
+	}
+	if got := field(line, "httpRequest", "referer"); got != "https://example.com/" {
+		t.Errorf("referer = %v, want https://example.com/", got)
+	}
+	if got := field(line, "httpRequest", "header"); got != nil {
+		t.Errorf("header = %v logged in concise mode", got)
+	}
+}
+
+func TestBytesIn(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	serve(logger, okHandler, httptest.NewRequest("POST", "/upload", strings.NewReader("hello world")))
+	if got := field(lastLine(t, buf), "httpRequest", "bytesIn"); got != float64(len("hello world")) {
+		t.Errorf("bytesIn = %v, want %d", got, len("hello world"))
+	}
+
+	buf.Reset()
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("chunked"))
+	req.ContentLength = -1
+	serve(logger, okHandler, req)
+	if got := field(lastLine(t, buf), "httpRequest", "bytesIn"); got != nil {
+		t.Errorf("bytesIn = %v for an unknown length", got)
+	}
+}
+
+func TestFieldGroup(t *testing.T) {
+	logger, buf := testLogger(t, Options{FieldGroup: "http"})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf)
+	}
+	if got := field(lines[0], "http", "httpRequest", "requestPath"); got != "/users" {
+		t.Errorf("request line http.httpRequest.requestPath = %v", got)
+	}
+	if got := field(lines[1], "http", "httpResponse", "status"); got != float64(200) {
+		t.Errorf("response line http.httpResponse.status = %v", got)
+	}
+	for _, line := range lines {
+		if _, ok := line["httpRequest"]; ok {
+			t.Errorf("httpRequest logged outside the http group:\n%s", buf)
+		}
+	}
+}
+
+type userKey struct{}
+
+func TestUserContextKey(t *testing.T) {
+	logger, buf := testLogger(t, Options{UserContextKey: userKey{}})
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, "user-42")))
+		})
+	}
+	h := auth(Handler(logger)(okHandler))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	for _, line := range logLines(t, buf) {
+		if line["userID"] != "user-42" {
+			t.Errorf("userID = %v, want user-42", line["userID"])
+		}
+	}
+}
+
+func TestLogResponseContentType(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogResponseContentType: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<p>ok</p>"))
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	if got := field(lastLine(t, buf), "httpResponse", "contentType"); got != "text/html; charset=utf-8" {
+		t.Errorf("contentType = %v", got)
+	}
+}
+
+func TestLogResponseContentEncoding(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogResponseContentEncoding: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte{0x1f, 0x8b})
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "contentEncoding"); got != "gzip" {
+		t.Errorf("contentEncoding = %v, want gzip", got)
+	}
+
+	buf.Reset()
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "contentEncoding"); got != nil {
+		t.Errorf("contentEncoding = %v for an unencoded response, want it omitted", got)
+	}
+}
+
+func TestLogTLS(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogTLS: true})
+	req := httptest.NewRequest("GET", "https://example.com/users", nil)
+	req.TLS.Version = tls.VersionTLS13
+	req.TLS.CipherSuite = tls.TLS_AES_128_GCM_SHA256
+	req.TLS.ServerName = "example.com"
+	serve(logger, okHandler, req)
+
+	request, _ := field(lastLine(t, buf), "httpRequest").(map[string]any)
+	if request["tlsVersion"] != "TLS 1.3" || request["tlsCipher"] != "TLS_AES_128_GCM_SHA256" || request["tlsServerName"] != "example.com" {
+		t.Errorf("tls fields = %v, %v, %v", request["tlsVersion"], request["tlsCipher"], request["tlsServerName"])
+	}
+
+	buf.Reset()
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpRequest", "tlsVersion"); got != nil {
+		t.Errorf("tlsVersion = %v for a plaintext request", got)
+	}
+}
+
+func TestStdHandler(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	h := StdHandler(logger, Config{RequestID: true, Recoverer: true})(mux)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", nil))
+	muxLine := lastLine(t, buf)
+
+	buf.Reset()
+	r := chi.NewRouter()
+	r.Use(RequestLoggerWith(logger, Config{RequestID: true, Recoverer: true}))
+	r.Post("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", nil))
+	chiLine := lastLine(t, buf)
+
+	if got := field(muxLine, "httpResponse", "status"); got != float64(http.StatusCreated) {
+		t.Errorf("httpResponse.status = %v, want 201", got)
+	}
+	if got := field(muxLine, "httpResponse", "bytes"); got != float64(len("created")) {
+		t.Errorf("httpResponse.bytes = %v, want %d", got, len("created"))
+	}
+	for _, group := range []string{"httpRequest", "httpResponse"} {
+		muxFields, _ := muxLine[group].(map[string]any)
+		chiFields, _ := chiLine[group].(map[string]any)
+		for key := range chiFields {
+			if _, ok := muxFields[key]; !ok {
+				t.Errorf("%s.%s logged with chi but not with http.ServeMux", group, key)
+			}
+		}
+	}
+}
+
+func TestConciseFollowsLevel(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept", "text/plain")
+
+	for _, level := range []string{"debug", "info", "debug"} {
+		SetLevel(level)
+		buf.Reset()
+		serve(logger, okHandler, req)
+
+		header := field(logLines(t, buf)[0], "httpRequest", "header")
+		if (header != nil) != (level == "debug") {
+			t.Errorf("level %s: httpRequest.header = %v", level, header)
+		}
+	}
+}
+
+func TestConciseTestLogger(t *testing.T) {
+	testLogger(t, Options{Concise: true})
+	logger, buf := NewTestLogger()
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept", "text/plain")
+	serve(logger, okHandler, req)
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 || field(lines[0], "httpRequest", "header") != nil {
+		t.Errorf("NewTestLogger ignored Concise:\n%s", buf)
+	}
+}
+
+func TestForceVerbose(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	debug := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Debug") == "1" {
+				r = r.WithContext(ForceVerbose(r.Context()))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := debug(Handler(logger)(okHandler))
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-Debug", "1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got := field(logLines(t, buf)[0], "httpRequest", "header", "x-debug"); got != "1" {
+		t.Errorf("forced request: httpRequest.header.x-debug = %v, want 1", got)
+	}
+
+	buf.Reset()
+	req = httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept", "text/plain")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	for _, line := range logLines(t, buf) {
+		if got := field(line, "httpRequest", "header"); got != nil {
+			t.Errorf("normal request: httpRequest.header = %v", got)
+		}
+	}
+}
+
+func TestForceVerboseFromHandler(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ForceVerbose(r.Context())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	if got := field(lastLine(t, buf), "httpResponse", "header", "content-type"); got != "text/plain" {
+		t.Errorf("httpResponse.header.content-type = %v, want text/plain", got)
+	}
+}
+
+func TestMaxHeaderValueLen(t *testing.T) {
+	logger, buf := testLogger(t, Options{MaxHeaderValueLen: 8})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-Trace", strings.Repeat("a", 4096))
+	req.Header.Set("Accept", "*/*")
+	serve(logger, okHandler, req)
+
+	header, _ := field(logLines(t, buf)[0], "httpRequest", "header").(map[string]any)
+	if got := header["x-trace"]; got != "aaaaaaaa..." {
+		t.Errorf("x-trace = %v, want it truncated to 8 bytes", got)
+	}
+	if got := header["accept"]; got != "*/*" {
+		t.Errorf("accept = %v, want it unchanged", got)
+	}
+}
+
+func TestErrorHooks(t *testing.T) {
+	var panicValue interface{}
+	var panicStack []byte
+	var serverErrors []int
+	logger, _ := testLogger(t, Options{
+		OnPanic: func(ctx context.Context, v interface{}, stack []byte) {
+			panicValue, panicStack = v, stack
+		},
+		OnServerError: func(ctx context.Context, status int) {
+			serverErrors = append(serverErrors, status)
+		},
+	})
+
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	serve(logger, middleware.Recoverer(panicking), httptest.NewRequest("GET", "/users", nil))
+	serve(logger, statusHandler(http.StatusBadGateway), httptest.NewRequest("GET", "/users", nil))
+	serve(logger, statusHandler(http.StatusNotFound), httptest.NewRequest("GET", "/users", nil))
+
+	if panicValue != "boom" || len(panicStack) == 0 {
+		t.Errorf("OnPanic got %v with a %d byte stack", panicValue, len(panicStack))
+	}
+	if len(serverErrors) != 2 || serverErrors[0] != http.StatusInternalServerError || serverErrors[1] != http.StatusBadGateway {
+		t.Errorf("OnServerError got %v, want [500 502]", serverErrors)
+	}
+}
+
+func TestRedirectLocation(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "location"); got != "/login" {
+		t.Errorf("location = %v, want /login", got)
+	}
+
+	buf.Reset()
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/users/1")
+		w.WriteHeader(http.StatusCreated)
+	})
+	serve(logger, h, httptest.NewRequest("POST", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "location"); got != nil {
+		t.Errorf("location = %v logged for a 201", got)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogQuery: true})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users?page=2&sort=name", nil))
+	if got := field(lastLine(t, buf), "httpRequest", "query"); got != "page=2&sort=name" {
+		t.Errorf("query = %v, want page=2&sort=name", got)
+	}
+
+	buf.Reset()
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpRequest", "query"); got != nil {
+		t.Errorf("query = %v for a request without a query string", got)
+	}
+}
+
+func TestHostname(t *testing.T) {
+	logger, buf := testLogger(t, Options{Hostname: "pod-7"})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	for _, line := range logLines(t, buf) {
+		if line["hostname"] != "pod-7" {
+			t.Errorf("hostname = %v, want pod-7", line["hostname"])
+		}
+	}
+}
+
+func TestLogEntrySetGroup(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogEntrySetGroup(r.Context(), "user", map[string]interface{}{"id": "42", "role": "admin"})
+		w.WriteHeader(http.StatusOK)
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	user, _ := lastLine(t, buf)["user"].(map[string]any)
+	if len(user) != 2 || user["id"] != "42" || user["role"] != "admin" {
+		t.Errorf("user = %v, want {id: 42, role: admin}", user)
+	}
+}
+
+func TestLogOnlyErrors(t *testing.T) {
+	logger, buf := testLogger(t, Options{LogOnlyErrors: true})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if buf.Len() != 0 {
+		t.Errorf("200 logged with LogOnlyErrors:\n%s", buf)
+	}
+
+	serve(logger, statusHandler(http.StatusInternalServerError), httptest.NewRequest("GET", "/users", nil))
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines for a 500, want the request and response lines:\n%s", len(lines), buf)
+	}
+	if lines[0]["msg"] != "Request: GET /users" || field(lines[1], "httpResponse", "status") != float64(500) {
+		t.Errorf("unexpected lines for a 500:\n%s", buf)
+	}
+}
+
+func TestLogOnlyErrorsSkipRoutePatterns(t *testing.T) {
+	logger, buf := testLogger(t, Options{LogOnlyErrors: true, SkipRoutePatterns: []string{"/metrics"}})
+	r := chi.NewRouter()
+	r.Use(Handler(logger))
+	r.Get("/metrics", statusHandler(http.StatusInternalServerError))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	if buf.Len() != 0 {
+		t.Errorf("skipped route logged:\n%s", buf)
+	}
+}
+
+func TestResponseRequestIDHeader(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, ResponseRequestIDHeader: "X-Request-ID"})
+	rec := httptest.NewRecorder()
+	RequestLogger(logger)(okHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/users", nil))
+
+	got := rec.Header().Get("X-Request-ID")
+	if got == "" {
+		t.Fatal("X-Request-ID response header not set")
+	}
+	if logged := field(lastLine(t, buf), "httpRequest", "requestID"); logged != got {
+		t.Errorf("response header %q does not match the logged requestID %v", got, logged)
+	}
+}
+
+func TestLogRequestStart(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogRequestStart: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := len(logLines(t, buf)); n != 1 {
+			t.Errorf("got %d lines while the handler runs, want the start line", n)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf)
+	}
+	if lines[0]["msg"] != "Request: GET /users" || field(lines[0], "httpRequest", "requestPath") != "/users" {
+		t.Errorf("start line = %v", lines[0])
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("short"))
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if got := field(line, "httpResponse", "contentLengthMismatch"); got != true {
+		t.Errorf("contentLengthMismatch = %v, want true", got)
+	}
+	if line["level"] != "WARN" {
+		t.Errorf("level = %v, want WARN", line["level"])
+	}
+
+	buf.Reset()
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "2")
+		w.Write([]byte("ok"))
+	})
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "contentLengthMismatch"); got != nil {
+		t.Errorf("contentLengthMismatch = %v for a matching length", got)
+	}
+}
+
+func TestLogEntryRemoveField(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	placeholder := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			LogEntrySetField(r.Context(), "tenant", "unknown")
+			LogEntrySetField(r.Context(), "region", "eu")
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogEntryRemoveField(r.Context(), "tenant")
+		w.WriteHeader(http.StatusOK)
+	})
+	serve(logger, placeholder(h), httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if _, ok := line["tenant"]; ok {
+		t.Errorf("removed field tenant logged:\n%s", buf)
+	}
+	if line["region"] != "eu" {
+		t.Errorf("region = %v, want eu", line["region"])
+	}
+	if field(line, "httpRequest", "requestPath") != "/users" {
+		t.Errorf("request fields lost when removing a field:\n%s", buf)
+	}
+}
+
+func TestRequestIDFieldName(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, RequestIDFieldName: "trace_id"})
+	RequestLogger(logger)(okHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	request, _ := field(lastLine(t, buf), "httpRequest").(map[string]any)
+	if id, _ := request["trace_id"].(string); id == "" {
+		t.Errorf("trace_id missing: %v", request)
+	}
+	if _, ok := request["requestID"]; ok {
+		t.Errorf("requestID logged along trace_id: %v", request)
+	}
+}
+
+func TestSkipPathsVariadic(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := RequestLogger(logger, []string{"/health"}, []string{"/ready"})(okHandler)
+	for _, path := range []string{"/health", "/ready", "/users"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 || field(lines[0], "httpRequest", "requestPath") != "/users" {
+		t.Errorf("want only /users logged, got:\n%s", buf)
+	}
+}
+
+func TestSortHeaderValues(t *testing.T) {
+	testLogger(t, Options{SortHeaderValues: true})
+
+	var first []slog.Attr
+	for i := 0; i < 20; i++ {
+		header := http.Header{}
+		header.Add("Accept", "text/plain")
+		header.Add("Accept", "application/json")
+		header.Set("X-B", "b")
+		header.Set("X-A", "a")
+		if i%2 == 1 {
+			header["Accept"] = []string{"application/json", "text/plain"}
+		}
+
+		attrs := headerLogField(header)
+		if i == 0 {
+			first = attrs
+			continue
+		}
+		if fmt.Sprint(attrs) != fmt.Sprint(first) {
+			t.Fatalf("headerLogField output changed between runs: %v, then %v", first, attrs)
+		}
+	}
+	if got := fmt.Sprint(first); got != "[accept=[application/json], [text/plain] x-a=a x-b=b]" {
+		t.Errorf("headerLogField = %s", got)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	const n = 5
+	var started sync.WaitGroup
+	started.Add(n)
+	release := make(chan struct{})
+	h := Handler(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}))
+
+	var done sync.WaitGroup
+	for i := 0; i < n; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+		}()
+	}
+	started.Wait()
+	close(release)
+	done.Wait()
+
+	var max float64
+	for _, line := range logLines(t, buf) {
+		v, ok := field(line, "httpRequest", "inFlight").(float64)
+		if !ok || v < 1 || v > n {
+			t.Errorf("inFlight = %v, want 1 to %d", field(line, "httpRequest", "inFlight"), n)
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if max != n {
+		t.Errorf("max inFlight = %v, want %d", max, n)
+	}
+
+	buf.Reset()
+	started.Add(1)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpRequest", "inFlight"); got != float64(1) {
+		t.Errorf("inFlight = %v after the others completed, want 1", got)
+	}
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	logger, _ := testLogger(t, Options{ServerTimingHeader: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+
+	rec := serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+	var dur float64
+	if _, err := fmt.Sscanf(rec.Header().Get("Server-Timing"), "total;dur=%g", &dur); err != nil {
+		t.Fatalf("Server-Timing = %q: %v", rec.Header().Get("Server-Timing"), err)
+	}
+	if dur < 2 {
+		t.Errorf("Server-Timing dur = %v, want at least 2ms", dur)
+	}
+
+	Configure(Options{})
+	rec = serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if got := rec.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("Server-Timing = %q without the option, want none", got)
+	}
+}
+
+func TestServerTimingWriterUnwrap(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &serverTimingWriter{ResponseWriter: rec, start: time.Now()}
+	if got := w.Unwrap(); got != rec {
+		t.Errorf("Unwrap = %v, want the wrapped writer", got)
+	}
+}
+
+func TestRedactPlaceholder(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		RedactPlaceholder: "[REDACTED]",
+		LogQueryParams:    true,
+		RedactQueryParams: []string{"token"},
+	})
+	req := httptest.NewRequest("GET", "/users?token=s3cr3t", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	serve(logger, okHandler, req)
+
+	line := logLines(t, buf)[0]
+	if got := field(line, "httpRequest", "header", "authorization"); got != "[REDACTED]" {
+		t.Errorf("authorization header = %v, want [REDACTED]", got)
+	}
+	if got := field(line, "httpRequest", "queryParams", "token"); got != "[REDACTED]" {
+		t.Errorf("token query param = %v, want [REDACTED]", got)
+	}
+}
+
+func TestLogHTTP2(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogHTTP2: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	serve(logger, okHandler, req)
+	if got := field(lastLine(t, buf), "httpRequest", "http2"); got != true {
+		t.Errorf("http2 = %v, want true", got)
+	}
+
+	buf.Reset()
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpRequest", "http2"); got != false {
+		t.Errorf("http2 = %v for HTTP/1.1, want false", got)
+	}
+}
+
+func TestNowFunc(t *testing.T) {
+	clock := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	logger, buf := testLogger(t, Options{Concise: true, NowFunc: func() time.Time { return clock }})
+	serve(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clock = clock.Add(1500 * time.Millisecond)
+	}), httptest.NewRequest("GET", "/users", nil))
+
+	if got := field(lastLine(t, buf), "httpResponse", "elapsed"); got != float64(1500) {
+		t.Errorf("elapsed = %v, want 1500", got)
+	}
+}
+
+func TestMaxHeadersLogged(t *testing.T) {
+	logger, buf := testLogger(t, Options{MaxHeadersLogged: 3})
+	req := httptest.NewRequest("GET", "/users", nil)
+	for i := 0; i < 100; i++ {
+		req.Header.Set(fmt.Sprintf("X-Flood-%03d", i), "v")
+	}
+	serve(logger, okHandler, req)
+
+	header, _ := field(logLines(t, buf)[0], "httpRequest", "header").(map[string]any)
+	if len(header) != 4 {
+		t.Errorf("httpRequest.header has %d fields, want 3 and omitted: %v", len(header), header)
+	}
+	if got := header["omitted"]; got != float64(97) {
+		t.Errorf("omitted = %v, want 97", got)
+	}
+}
+
+func TestLogResponseHeadersAndBody(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	})
+	tests := []struct {
+		name          string
+		opts          Options
+		headers, body bool
+	}{
+		{"concise", Options{Concise: true}, false, false},
+		{"concise headers", Options{Concise: true, LogResponseHeaders: true}, true, false},
+		{"concise body", Options{Concise: true, LogResponseBody: true}, false, true},
+		{"concise headers and body", Options{Concise: true, LogResponseHeaders: true, LogResponseBody: true}, true, true},
+		{"verbose", Options{}, true, true},
+		{"verbose without headers", Options{OmitResponseHeaders: true}, false, true},
+		{"verbose without body", Options{OmitResponseBody: true}, true, false},
+		{"verbose without either", Options{OmitResponseHeaders: true, OmitResponseBody: true}, false, false},
+		{"omit wins", Options{Concise: true, LogResponseHeaders: true, OmitResponseHeaders: true}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := testLogger(t, tt.opts)
+			serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+			response, _ := field(lastLine(t, buf), "httpResponse").(map[string]any)
+			if _, ok := response["header"]; ok != tt.headers {
+				t.Errorf("header logged = %t, want %t: %v", ok, tt.headers, response)
+			}
+			if body, ok := response["body"]; ok != tt.body || (ok && body != "boom") {
+				t.Errorf("body = %v (logged %t), want logged %t", body, ok, tt.body)
+			}
+		})
+	}
+}
+
+func TestLogEntryWith(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	serve(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogEntryWith(r.Context(), "orderID", "o-1").Info("charging")
+	}), httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want the service line and the response", len(lines))
+	}
+	if got := lines[0]["orderID"]; got != "o-1" {
+		t.Errorf("orderID = %v on the derived logger's line, want o-1", got)
+	}
+	if _, ok := lines[1]["orderID"]; ok {
+		t.Errorf("orderID leaked into the response line: %v", lines[1])
+	}
+}
+
+func TestPathLevels(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		Concise:    true,
+		PathLevels: map[string]string{"/admin/*": "debug", "/static/*": "warn"},
+	})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogEntry(r.Context()).Debug("details")
+		w.Write([]byte("ok"))
+	})
+
+	serve(logger, h, httptest.NewRequest("GET", "/admin/users", nil))
+	if lines := logLines(t, buf); len(lines) != 2 || lines[0]["msg"] != "details" {
+		t.Errorf("want the debug line and the response for /admin/users, got:\n%s", buf)
+	}
+
+	buf.Reset()
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+	if lines := logLines(t, buf); len(lines) != 1 || lines[0]["msg"] == "details" {
+		t.Errorf("want only the response for /users, got:\n%s", buf)
+	}
+
+	buf.Reset()
+	serve(logger, h, httptest.NewRequest("GET", "/static/app.js", nil))
+	if buf.Len() != 0 {
+		t.Errorf("info response logged for /static at warn:\n%s", buf)
+	}
+}
+
+func TestLogURLParams(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogURLParams: true})
+	r := chi.NewRouter()
+	r.Use(Handler(logger))
+	r.Get("/orders/{orderID}/items/{itemID}", okHandler)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/123/items/7", nil))
+
+	params, _ := field(lastLine(t, buf), "httpResponse", "params").(map[string]any)
+	if len(params) != 2 || params["orderID"] != "123" || params["itemID"] != "7" {
+		t.Errorf("params = %v, want orderID=123 and itemID=7", params)
+	}
+}
+
+func TestNumericLevel(t *testing.T) {
+	logger, buf := testLogger(t, Options{NumericLevel: true, LogLevel: "debug"})
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+
+	want := []float64{7, 6, 4, 3}
+	lines := logLines(t, buf)
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		if got := line["severityNumber"]; got != want[i] {
+			t.Errorf("%s: severityNumber = %v, want %v", line["level"], got, want[i])
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	var id string
+	RequestLogger(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = RequestID(r.Context())
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	if id == "" {
+		t.Fatal("RequestID returned no ID inside the handler")
+	}
+	if got := field(lastLine(t, buf), "httpRequest", "requestID"); got != id {
+		t.Errorf("logged requestID = %v, want %q", got, id)
+	}
+	if got := RequestID(context.Background()); got != "" {
+		t.Errorf("RequestID without a request = %q, want empty", got)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	logger, buf := testLogger(t, Options{SchemaVersion: "2"})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want request and response", len(lines))
+	}
+	for _, line := range lines {
+		if got := line["schemaVersion"]; got != "2" {
+			t.Errorf("%s: schemaVersion = %v, want 2", line["msg"], got)
+		}
+	}
+}
+
+func TestLogHost(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogHost: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Host = "tenant-a.example.com:8443"
+	serve(logger, okHandler, req)
+
+	if got := field(lastLine(t, buf), "httpRequest", "host"); got != "tenant-a.example.com:8443" {
+		t.Errorf("host = %v, want tenant-a.example.com:8443", got)
+	}
+}
+
+func TestPanicked(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	serve(logger, middleware.Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})), httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "panicked"); got != true {
+		t.Errorf("panicked = %v, want true", got)
+	}
+
+	buf.Reset()
+	serve(logger, statusHandler(http.StatusInternalServerError), httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "panicked"); got != nil {
+		t.Errorf("panicked = %v for a plain 500, want it omitted", got)
+	}
+}
+
+func TestSkipDefaultPaths(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		logger, buf := testLogger(t, Options{Concise: true, SkipDefaultPaths: skip})
+		h := Handler(logger, []string{"/internal"})(okHandler)
+		for _, path := range append(append([]string(nil), defaultSkipPaths...), "/internal") {
+			buf.Reset()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			if logged, want := buf.Len() > 0, !skip && path != "/internal"; logged != want {
+				t.Errorf("SkipDefaultPaths=%t: %s logged = %t, want %t", skip, path, logged, want)
+			}
+		}
+	}
+}
+
+func TestLogQueryParams(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		Concise:           true,
+		LogQuery:          true,
+		LogQueryParams:    true,
+		RedactQueryParams: []string{"token"},
+	})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users?page=2&tag=a&tag=b&token=s3cr3t", nil))
+
+	request, _ := field(lastLine(t, buf), "httpRequest").(map[string]any)
+	params, _ := request["queryParams"].(map[string]any)
+	if len(params) != 3 || params["page"] != "2" || params["tag"] != "[a], [b]" || params["token"] != "***" {
+		t.Errorf("queryParams = %v, want page, both tags and a masked token", params)
+	}
+	if got := request["requestURL"]; got != "http://example.com/users?page=2&tag=a&tag=b&token=***" {
+		t.Errorf("requestURL = %v, want the token masked", got)
+	}
+	if got := request["query"]; got != "page=2&tag=a&tag=b&token=***" {
+		t.Errorf("query = %v, want the token masked", got)
+	}
+}
+
+func TestRedactQueryParamsAccessLog(t *testing.T) {
+	logger, buf := testLogger(t, Options{AccessLogFormat: AccessLogCommon, RedactQueryParams: []string{"token"}})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users?token=s3cr3t&page=2", nil))
+
+	if got := buf.String(); !strings.Contains(got, `"GET /users?token=***&page=2 HTTP/1.1"`) || strings.Contains(got, "s3cr3t") {
+		t.Errorf("access log line = %q, want the token masked", got)
+	}
+}
+
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		bounds  []time.Duration
+		elapsed time.Duration
+		want    string
+	}{
+		{nil, 0, "<10ms"},
+		{nil, 10*time.Millisecond - 1, "<10ms"},
+		{nil, 10 * time.Millisecond, "10ms-100ms"},
+		{nil, 100 * time.Millisecond, "100ms-1s"},
+		{nil, time.Second - 1, "100ms-1s"},
+		{nil, time.Second, ">=1s"},
+		{nil, time.Minute, ">=1s"},
+		{[]time.Duration{50 * time.Millisecond, 500 * time.Millisecond}, 50 * time.Millisecond, "50ms-500ms"},
+		{[]time.Duration{50 * time.Millisecond, 500 * time.Millisecond}, 500 * time.Millisecond, ">=500ms"},
+	}
+	t.Cleanup(func() { Configure(Options{}) })
+	for _, tt := range tests {
+		Configure(Options{LatencyBuckets: true, LatencyBucketBounds: tt.bounds})
+		if got := latencyBucket(tt.elapsed); got != tt.want {
+			t.Errorf("bounds %v: latencyBucket(%v) = %q, want %q", tt.bounds, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyBucketField(t *testing.T) {
+	clock := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	logger, buf := testLogger(t, Options{Concise: true, LatencyBuckets: true, NowFunc: func() time.Time { return clock }})
+	serve(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clock = clock.Add(100 * time.Millisecond)
+	}), httptest.NewRequest("GET", "/users", nil))
+
+	if got := field(lastLine(t, buf), "httpResponse", "latencyBucket"); got != "100ms-1s" {
+		t.Errorf("latencyBucket = %v, want 100ms-1s", got)
+	}
+}
+
+func TestLogEntrySetErrorField(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	for _, tt := range []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusInternalServerError, true},
+	} {
+		buf.Reset()
+		serve(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			LogEntrySetErrorField(r.Context(), "query", "SELECT 1")
+			LogEntrySetErrorFields(r.Context(), map[string]interface{}{"retries": 3})
+			w.WriteHeader(tt.status)
+		}), httptest.NewRequest("GET", "/users", nil))
+
+		line := lastLine(t, buf)
+		if _, ok := line["query"]; ok != tt.want {
+			t.Errorf("status %d: query logged = %t, want %t", tt.status, ok, tt.want)
+		}
+		if _, ok := line["retries"]; ok != tt.want {
+			t.Errorf("status %d: retries logged = %t, want %t", tt.status, ok, tt.want)
+		}
+	}
+}
+
+func TestLogEntryWithChiLogger(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	chiLogger := middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: log.New(io.Discard, "", 0)})
+
+	var found bool
+	h := chiLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := middleware.GetLogEntry(r).(*RequestLoggerEntry); ok {
+			t.Error("chi's logger did not replace the entry under its own key")
+		}
+		_, found = GetLogEntry(r.Context())
+		LogEntrySetField(r.Context(), "userID", "u-1")
+	}))
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+
+	if !found {
+		t.Error("GetLogEntry found no entry under chi's logger")
+	}
+	if got := lastLine(t, buf)["userID"]; got != "u-1" {
+		t.Errorf("userID = %v, want the field set through LogEntrySetField", got)
+	}
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.Write([]byte("late"))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil).WithContext(ctx))
+
+	line := lastLine(t, buf)
+	if got := field(line, "httpResponse", "deadlineExceeded"); got != true {
+		t.Errorf("deadlineExceeded = %v, want true", got)
+	}
+	if got := line["level"]; got != "WARN" {
+		t.Errorf("level = %v, want WARN", got)
+	}
+
+	buf.Reset()
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if got := field(lastLine(t, buf), "httpResponse", "deadlineExceeded"); got != nil {
+		t.Errorf("deadlineExceeded = %v without a deadline, want it omitted", got)
+	}
+}
+
+func TestForwardedSchemeHeader(t *testing.T) {
+	logger, buf := testLogger(t, Options{ForwardedSchemeHeader: "X-Forwarded-Proto"})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	serve(logger, okHandler, req)
+
+	request, _ := field(logLines(t, buf)[0], "httpRequest").(map[string]any)
+	if request["scheme"] != "https" || request["requestURL"] != "https://example.com/users" {
+		t.Errorf("scheme = %v, requestURL = %v, want https from the header", request["scheme"], request["requestURL"])
+	}
+
+	buf.Reset()
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if got := field(logLines(t, buf)[0], "httpRequest", "scheme"); got != "http" {
+		t.Errorf("scheme = %v without the header, want http", got)
+	}
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, CoalesceWindow: time.Hour})
+	t.Cleanup(Flush)
+	status := http.StatusInternalServerError
+	h := Handler(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	for i := 0; i < 5; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	}
+	if lines := logLines(t, buf); len(lines) != 1 || lines[0]["repeated"] != nil {
+		t.Fatalf("want only the first line of the run, got:\n%s", buf)
+	}
+
+	// A different line ends the run, logging its summary first.
+	status = http.StatusOK
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	lines := logLines(t, buf)
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want first, summary and the new line:\n%s", len(lines), buf)
+	}
+	if got := lines[1]["repeated"]; got != float64(4) {
+		t.Errorf("repeated = %v, want 4", got)
+	}
+	if got := field(lines[2], "httpResponse", "status"); got != float64(200) {
+		t.Errorf("status = %v after the run, want 200", got)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	Flush()
+	lines = logLines(t, buf)
+	if len(lines) != 4 || lines[3]["repeated"] != float64(1) {
+		t.Errorf("want Flush to log the held-back repeat, got:\n%s", buf)
+	}
+}
+
+func TestCoalesceWindowExpires(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, CoalesceWindow: 10 * time.Millisecond})
+	h := Handler(logger)(okHandler)
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	}
+	time.Sleep(50 * time.Millisecond)
+	// Flush has nothing left to log, but orders the read of buf after the
+	// summary written by the expired window.
+	Flush()
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 || lines[1]["repeated"] != float64(2) {
+		t.Errorf("want the first line and a summary after the window, got:\n%s", buf)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, RequestTimeout: 10 * time.Millisecond})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	rec := serve(logger, slow, httptest.NewRequest("GET", "/users", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	line := lastLine(t, buf)
+	if got := field(line, "httpResponse", "timedOut"); got != true {
+		t.Errorf("timedOut = %v, want true", got)
+	}
+	if got := line["level"]; got != "WARN" {
+		t.Errorf("level = %v, want WARN", got)
+	}
+
+	buf.Reset()
+	rec = serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	if rec.Code != http.StatusOK || field(lastLine(t, buf), "httpResponse", "timedOut") != nil {
+		t.Errorf("fast handler: status = %d, line:\n%s", rec.Code, buf)
+	}
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, CacheStatusHeader: "X-Cache"})
+	for _, status := range []string{"HIT", "MISS", ""} {
+		buf.Reset()
+		serve(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status != "" {
+				w.Header().Set("X-Cache", status)
+			}
+			w.Write([]byte("ok"))
+		}), httptest.NewRequest("GET", "/users", nil))
+
+		got, ok := field(lastLine(t, buf), "httpResponse", "cacheStatus").(string)
+		if ok != (status != "") || got != status {
+			t.Errorf("X-Cache %q: cacheStatus = %q (logged %t)", status, got, ok)
+		}
+	}
+}
+
+func TestSkipFunc(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		Concise: true,
+		SkipFunc: func(r *http.Request) bool {
+			return r.Header.Get("X-Synthetic-Check") != ""
+		},
+	})
+	var served int
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	})
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-Synthetic-Check", "1")
+	serve(logger, h, req)
+	if buf.Len() != 0 {
+		t.Errorf("skipped request logged:\n%s", buf)
+	}
+
+	serve(logger, h, httptest.NewRequest("GET", "/users", nil))
+	if len(logLines(t, buf)) != 1 {
+		t.Errorf("want the other request logged, got:\n%s", buf)
+	}
+	if served != 2 {
+		t.Errorf("handler served %d requests, want 2", served)
+	}
+}
+
+func TestRequestTimeoutAbandonedHandler(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, RequestTimeout: 10 * time.Millisecond})
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprintf("k%d", i%4)
+			LogEntrySetField(r.Context(), key, "v")
+			LogEntrySetFields(r.Context(), map[string]interface{}{"n": i})
+			LogEntrySetErrorField(r.Context(), key, "v")
+			LogEntrySetGroup(r.Context(), "g", map[string]interface{}{"n": i})
+			LogEntryRemoveField(r.Context(), key)
+			LogEntrySetMessage(r.Context(), "late")
+			LogEntrySetError(r.Context(), errors.New("late"))
+			DisableBodyCapture(r.Context())
+			ForceVerbose(r.Context())
+			LogEntry(r.Context())
+		}
+	})
+
+	rec := serve(logger, slow, httptest.NewRequest("GET", "/users", nil))
+	// Let the abandoned handler carry on past Write.
+	time.Sleep(5 * time.Millisecond)
+	close(stop)
+	<-stopped
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	if got := field(lastLine(t, buf), "httpResponse", "timedOut"); got != true {
+		t.Errorf("timedOut = %v, want true", got)
+	}
+}
+
+func TestCoalesceWindowPerHandler(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, CoalesceWindow: time.Hour})
+	t.Cleanup(Flush)
+	billing := newLogger("billing", slog.Default(), DefaultOptions)
+	api := Handler(logger)(statusHandler(http.StatusInternalServerError))
+	bill := Handler(billing)(statusHandler(http.StatusInternalServerError))
+
+	api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	bill.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	Flush()
+
+	lines := logLines(t, buf)
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want the first line of each service and the api summary:\n%s", len(lines), buf)
+	}
+	var services []string
+	for _, line := range lines {
+		services = append(services, fmt.Sprintf("%v:%v", line["service"], line["repeated"]))
+	}
+	if got := strings.Join(services, " "); got != "test:<nil> billing:<nil> test:1" {
+		t.Errorf("lines = %s, want test:<nil> billing:<nil> test:1", got)
+	}
+}
@@ -0,0 +1,165 @@
+package httpslog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// logfmtHandler is a slog.Handler writing logfmt records
+// (key=value key2="value two"). Groups are flattened into dotted keys,
+// e.g. httpResponse.status=200.
+type logfmtHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	opts   slog.HandlerOptions
+	attrs  []byte
+	groups []string
+}
+
+func newLogfmtHandler(w io.Writer, opts *slog.HandlerOptions) *logfmtHandler {
+	h := &logfmtHandler{w: w, mu: &sync.Mutex{}}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Level == nil {
+		h.opts.Level = slog.LevelInfo
+	}
+	return h
+}
+
+func (h *logfmtHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+func (h *logfmtHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if !r.Time.IsZero() {
+		h.appendAttr(&buf, nil, slog.Time(slog.TimeKey, r.Time))
+	}
+	h.appendAttr(&buf, nil, slog.Any(slog.LevelKey, r.Level))
+	if h.opts.AddSource && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		h.appendAttr(&buf, nil, slog.Any(slog.SourceKey, &slog.Source{
+			Function: frame.Function,
+			File:     frame.File,
+			Line:     frame.Line,
+		}))
+	}
+	h.appendAttr(&buf, nil, slog.String(slog.MessageKey, r.Message))
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		h.appendAttr(&buf, h.groups, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Drop the separator written before the first key.
+	_, err := h.w.Write(buf.Bytes()[1:])
+	return err
+}
+
+func (h *logfmtHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	buf := bytes.NewBuffer(append([]byte(nil), h.attrs...))
+	for _, a := range attrs {
+		h.appendAttr(buf, h.groups, a)
+	}
+	h2.attrs = buf.Bytes()
+	return &h2
+}
+
+func (h *logfmtHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &h2
+}
+
+func (h *logfmtHandler) appendAttr(buf *bytes.Buffer, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		if a.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], a.Key)
+		}
+		for _, ga := range attrs {
+			h.appendAttr(buf, groups, ga)
+		}
+		return
+	}
+
+	if h.opts.ReplaceAttr != nil {
+		a = h.opts.ReplaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+	if a.Key == "" {
+		return
+	}
+
+	buf.WriteByte(' ')
+	for _, g := range groups {
+		writeLogfmtKey(buf, g)
+		buf.WriteByte('.')
+	}
+	writeLogfmtKey(buf, a.Key)
+	buf.WriteByte('=')
+	buf.WriteString(logfmtValue(a.Value))
+}
+
+// writeLogfmtKey writes key with spaces, "=", quotes, backslashes and
+// non-printable characters replaced by "_". Keys can come from the
+// request, e.g. query parameter names, and must not be able to end the
+// key early or start a forged line.
+func writeLogfmtKey(buf *bytes.Buffer, key string) {
+	for _, r := range key {
+		if r == ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r) {
+			buf.WriteByte('_')
+			continue
+		}
+		buf.WriteRune(r)
+	}
+}
+
+// logfmtValue renders v, quoting it when it is empty or contains spaces,
+// quotes, "=" or non-printable characters.
+func logfmtValue(v slog.Value) string {
+	var s string
+	switch v.Kind() {
+	case slog.KindTime:
+		s = v.Time().Format(time.RFC3339Nano)
+	case slog.KindDuration:
+		s = v.Duration().String()
+	case slog.KindAny:
+		if src, ok := v.Any().(*slog.Source); ok {
+			s = fmt.Sprintf("%s:%d", src.File, src.Line)
+			break
+		}
+		s = v.String()
+	default:
+		s = v.String()
+	}
+
+	needsQuote := s == "" || strings.ContainsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+	})
+	if needsQuote {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package httpslog
+
+import (
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatLogfmt, Concise: true, OmitTime: true})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := strings.TrimSuffix(buf.String(), "\n")
+	for _, want := range []string{
+		`level=INFO msg="Response: 200 OK" service=test`,
+		" httpRequest.requestMethod=GET ",
+		" httpRequest.requestPath=/users ",
+		" httpResponse.status=200 ",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("line lacks %q:\n%s", want, line)
+		}
+	}
+	if strings.Contains(line, "\n") || strings.Contains(line, "{") {
+		t.Errorf("line is not flat logfmt:\n%s", line)
+	}
+}
+
+func TestLogfmtQuoting(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatLogfmt, OmitTime: true})
+	logger.Info("hello", "plain", "value", "spaced", "value two", "quoted", `say "hi"`, "empty", "", "eq", "a=b")
+
+	want := `level=INFO msg=hello service=test hostname=test-host plain=value spaced="value two" quoted="say \"hi\"" empty="" eq="a=b"` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("line = %s, want %s", got, want)
+	}
+}
+
+func TestLogfmtHostileKey(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatLogfmt, Concise: true, LogQueryParams: true})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users?x%0Alevel%3DERROR+msg%3Dforged=1", nil))
+
+	out := buf.String()
+	if n := strings.Count(out, "\n"); n != 1 {
+		t.Fatalf("got %d lines, want 1:\n%s", n, out)
+	}
+	if strings.Contains(out, " level=ERROR") || strings.Contains(out, " msg=forged") {
+		t.Errorf("query key forged fields:\n%s", out)
+	}
+	if want := " httpRequest.queryParams.x_level_ERROR_msg_forged=1"; !strings.Contains(out, want) {
+		t.Errorf("line lacks %q:\n%s", want, out)
+	}
+}
+
+func TestLogfmtAddSource(t *testing.T) {
+	logger, buf := testLogger(t, Options{Format: FormatLogfmt, AddSource: true, OmitTime: true})
+	logger.Info("hello")
+
+	line := buf.String()
+	i := strings.Index(line, " source=")
+	if i < 0 {
+		t.Fatalf("line lacks source:\n%s", line)
+	}
+	source, _, _ := strings.Cut(line[i+len(" source="):], " ")
+	if !strings.Contains(source, "logfmt_test.go:") {
+		t.Errorf("source = %s, want file:line of the caller", source)
+	}
+	if !strings.HasPrefix(line, "level=INFO source=") {
+		t.Errorf("source not after level:\n%s", line)
+	}
+}
+
+func TestLogfmtAddSourceReplaceAttr(t *testing.T) {
+	logger, buf := testLogger(t, Options{
+		Format:    FormatLogfmt,
+		AddSource: true,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if src, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+				return slog.String("caller", filepath.Base(src.File))
+			}
+			return a
+		},
+	})
+	logger.Info("hello")
+
+	if line := buf.String(); !strings.Contains(line, " caller=logfmt_test.go ") || strings.Contains(line, " source=") {
+		t.Errorf("ReplaceAttr not applied to source:\n%s", line)
+	}
+}
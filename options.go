@@ -1,37 +1,419 @@
 package httpslog
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 )
 
+const (
+	FormatJSON    = "json"
+	FormatDatadog = "datadog"
+	FormatGELF    = "gelf"
+	FormatW3C     = "w3c"
+	FormatLogfmt  = "logfmt"
+
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+)
+
+var (
+	logWriter   io.Writer = os.Stdout
+	asyncWriter *AsyncWriter
+	levelVar    = new(slog.LevelVar)
+)
+
 var DefaultOptions = Options{
-	LogLevel:        "info",
-	LevelFieldName:  "level",
-	Concise:         false,
-	Tags:            nil,
-	SkipHeaders:     nil,
-	TimeFieldFormat: time.RFC3339Nano,
-	TimeFieldName:   "timestamp",
+	LogLevel:           "info",
+	Format:             FormatJSON,
+	LevelFieldName:     "level",
+	Concise:            false,
+	Tags:               nil,
+	SkipHeaders:        nil,
+	TimeFieldFormat:    time.RFC3339Nano,
+	TimeFieldName:      "timestamp",
+	UnifiedEntry:       false,
+	AddSource:          false,
+	PrintPrettyStack:   false,
+	PanicLevel:         "error",
+	ElapsedUnit:        "ms",
+	ElapsedFieldName:   "elapsed",
+	UserFieldName:      "userID",
+	RequestIDFieldName: "requestID",
+	RedactPlaceholder:  "***",
 }
 
 type Options struct {
 	LogLevel        string
+	Format          string
 	LevelFieldName  string
 	Concise         bool
 	Tags            map[string]string
 	SkipHeaders     []string
 	TimeFieldFormat string
 	TimeFieldName   string
+
+	// UnifiedEntry suppresses the request log line and emits a single
+	// entry at response time carrying both httpRequest and httpResponse.
+	UnifiedEntry bool
+
+	// RequestMsgFunc and ResponseMsgFunc override the default
+	// "Request: ..." and "Response: ..." log messages when set.
+	RequestMsgFunc  func(r *http.Request) string
+	ResponseMsgFunc func(status int) string
+
+	// AccessLogFormat renders each completed request as a plain
+	// NCSA access log line ("common" or "combined") instead of JSON. The
+	// lines are logged at the response level, so LogLevel and PathLevels
+	// still apply; a logger from NewLoggerFromHandler receives the line's
+	// fields as an accessLog group.
+	AccessLogFormat string
+
+	// FieldEncryptor, when set, is applied to sensitive values instead of
+	// replacing them with RedactPlaceholder, e.g. to plug in envelope
+	// encryption.
+	FieldEncryptor func(field, value string) string
+
+	// AddSource adds the caller's source file and line to each log line.
+	AddSource bool
+
+	// LogBodyHash logs a SHA-256 of the request body as bodyHash without
+	// logging the body itself. At most MaxBodyHashSize bytes (default
+	// 1MB) are read ahead of the handler; larger bodies are not hashed
+	// and are flagged with bodyTooLarge instead.
+	LogBodyHash     bool
+	MaxBodyHashSize int
+
+	// Fingerprint logs a short hash of the request method and path (and
+	// body, with LogBodyHash) as requestFingerprint, e.g. to spot retry
+	// storms.
+	Fingerprint bool
+
+	// LargeResponseThreshold flags responses larger than this many bytes
+	// with largeResponse and logs them at least at Warn. Zero disables it.
+	LargeResponseThreshold int
+
+	// CoalesceWindow collapses identical consecutive response log lines
+	// (same level, message, method, path and error) of a Handler within
+	// this window: the first is logged as usual, the repeats as a single
+	// line with a repeated count. Zero disables it.
+	CoalesceWindow time.Duration
+
+	// RequestTimeout bounds the handler's run time like http.TimeoutHandler:
+	// past it, the client gets a 503 and the response is logged at Warn
+	// with timedOut. Handlers then can't use http.Flusher or http.Hijacker,
+	// and fields they set once timed out are dropped. Zero disables it.
+	RequestTimeout time.Duration
+
+	// SemConv emits request and response fields as top-level attributes
+	// using OpenTelemetry semantic-convention names (http.request.method,
+	// url.path...) instead of the httpRequest and httpResponse groups.
+	SemConv bool
+
+	// AnonymizeIP masks the last octet of IPv4 and the lower 80 bits of
+	// IPv6 client addresses before they are logged.
+	AnonymizeIP bool
+
+	// OnResponse is called after each request has been logged, e.g. to
+	// record metrics. It is not called for skipped paths.
+	OnResponse func(r *http.Request, status, bytes int, elapsed time.Duration)
+
+	// ResponseHeaders limits the logged response headers to the named
+	// ones (case-insensitive). When empty, all response headers are logged.
+	ResponseHeaders []string
+
+	// LogResponseHeaders and LogResponseBody log the response headers and
+	// error bodies respectively even in Concise mode. OmitResponseHeaders
+	// and OmitResponseBody leave them out even in verbose mode, e.g. to
+	// log error bodies without the header noise, and win over the former.
+	LogResponseHeaders  bool
+	LogResponseBody     bool
+	OmitResponseHeaders bool
+	OmitResponseBody    bool
+
+	// RedactHeaders are masked in addition to the built-in set
+	// (authorization, cookie, set-cookie, x-api-key, x-auth-token), which
+	// can be turned off with DisableDefaultRedaction.
+	RedactHeaders           []string
+	DisableDefaultRedaction bool
+
+	// PrintPrettyStack additionally prints chi's colored stack trace to
+	// stdout on panic. Useful in development, breaks JSON-only output.
+	PrintPrettyStack bool
+
+	// PanicLevel is the level of the response log line for a recovered
+	// panic ("debug", "info", "warn" or "error"). Defaults to "error".
+	PanicLevel string
+
+	// PathLevels sets the minimum level per request path, overriding
+	// LogLevel for matching requests. Keys match exactly, or by prefix
+	// when ending in "*" (e.g. "/admin/*"); the longest prefix wins.
+	PathLevels map[string]string
+
+	// RequestIDHeader names an incoming header whose value, when present,
+	// is used as the request ID instead of the generated one.
+	RequestIDHeader string
+
+	// ForwardedSchemeHeader names a header set by a TLS-terminating proxy
+	// (e.g. "X-Forwarded-Proto") to take the logged scheme and requestURL
+	// from. Without it, or when it is absent, r.TLS decides.
+	ForwardedSchemeHeader string
+
+	// ElapsedUnit is the unit of the logged elapsed time: "ns", "ms" or "s".
+	ElapsedUnit      string
+	ElapsedFieldName string
+
+	// LatencyBuckets adds a latencyBucket label classifying the elapsed
+	// time by LatencyBucketBounds, which must be ascending. Defaults to
+	// 10ms, 100ms and 1s.
+	LatencyBuckets      bool
+	LatencyBucketBounds []time.Duration
+
+	// BeforeRequest and AfterRequest are called by Handler right before
+	// and after the wrapped handler runs.
+	BeforeRequest func(ctx context.Context, r *http.Request)
+	AfterRequest  func(ctx context.Context, status int)
+
+	// Writers are the log outputs. Each line is written to all of them.
+	// Defaults to os.Stdout. Use NewRotatingFile, or any rotating writer
+	// such as a *lumberjack.Logger, to bound the size of log files.
+	Writers []io.Writer
+
+	// UseStderr logs to os.Stderr instead of os.Stdout when no Writers
+	// are set.
+	UseStderr bool
+
+	// StatusLevelFunc and StatusLabelFunc override the default mapping of
+	// response status codes to log levels and message labels.
+	StatusLevelFunc func(status int) slog.Level
+	StatusLabelFunc func(status int) string
+
+	// OmitTime drops the time field from every record, e.g. when a log
+	// collector adds its own timestamp.
+	OmitTime bool
+
+	// NumericLevel adds a severityNumber field with the RFC 5424 severity
+	// of each record (error 3, warn 4, info 6, debug 7).
+	NumericLevel bool
+
+	// SkipRoutePatterns suppresses the response log for requests matched
+	// by one of these chi route patterns (e.g. "/users/{id}"). Since chi
+	// routes after the middleware has run, the request log is unaffected.
+	SkipRoutePatterns []string
+
+	// SkipDefaultPaths skips logging for the usual health-check and
+	// metrics endpoints (/health, /healthz, /ready, /metrics and /ping),
+	// in addition to the paths given to Handler.
+	SkipDefaultPaths bool
+
+	// SkipFunc skips logging for the requests it returns true for, e.g.
+	// based on a header or the user agent.
+	SkipFunc func(r *http.Request) bool
+
+	// LogURLParams adds the chi URL parameters (e.g. {orderID}) as a
+	// params group. Like the route pattern, they are only known once chi
+	// has routed the request, so they appear on the response log only.
+	LogURLParams bool
+
+	// LogUserAgent and LogReferer add the userAgent and referer request
+	// fields, including in concise mode.
+	LogUserAgent bool
+	LogReferer   bool
+
+	// LogHost adds the request Host as the host request field, e.g. to
+	// filter by tenant domain.
+	LogHost bool
+
+	// FieldGroup nests the httpRequest and httpResponse groups under a
+	// single key (e.g. "http"). Request fields are then only attached to
+	// the middleware's own log lines, not to logs made through LogEntry.
+	FieldGroup string
+
+	// FieldRename maps attribute keys to the names written in the output,
+	// e.g. {"msg": "message"}. Keys not in the map are kept as is.
+	FieldRename map[string]string
+
+	// DropFields removes the named attributes from every record, at any
+	// nesting level (e.g. "proto", "header").
+	DropFields []string
+
+	// ReplaceAttr is passed on to slog.HandlerOptions, for customizations
+	// the other options don't cover. It runs after OmitTime, FieldRename
+	// and DropFields, and is not called for group keys.
+	ReplaceAttr func(groups []string, a slog.Attr) slog.Attr
+
+	// UserContextKey is the context key under which an upstream middleware
+	// stores the authenticated user. When set, its value is logged on every
+	// line of the request as UserFieldName (default "userID").
+	UserContextKey interface{}
+	UserFieldName  string
+
+	// LogResponseContentType and LogResponseContentEncoding add the
+	// response Content-Type and Content-Encoding as the contentType and
+	// contentEncoding fields, including in concise mode.
+	LogResponseContentType     bool
+	LogResponseContentEncoding bool
+
+	// CacheStatusHeader names a response header (e.g. "X-Cache") whose
+	// value, such as HIT or MISS, is logged as cacheStatus.
+	CacheStatusHeader string
+
+	// LogTLS adds the negotiated TLS version, cipher suite and SNI server
+	// name to HTTPS requests.
+	LogTLS bool
+
+	// Async writes logs through an AsyncWriter with a queue of
+	// AsyncBufferSize lines (default 1024). When the queue is full, lines
+	// are dropped unless AsyncBlock is set. Use Flush to drain it.
+	Async           bool
+	AsyncBufferSize int
+	AsyncBlock      bool
+
+	// MaxHeaderValueLen truncates logged header values longer than this
+	// many bytes, marking them with "...". Zero means unlimited.
+	MaxHeaderValueLen int
+
+	// MaxHeadersLogged caps the number of header fields logged per
+	// request or response; the rest are counted in an "omitted" field.
+	// Zero means unlimited.
+	MaxHeadersLogged int
+
+	// OnPanic is called with each recovered panic and OnServerError with
+	// each 5xx response, e.g. to report them to an error tracker.
+	OnPanic       func(ctx context.Context, v interface{}, stack []byte)
+	OnServerError func(ctx context.Context, status int)
+
+	// LogQuery adds the raw query string as the query request field.
+	LogQuery bool
+
+	// LogQueryParams adds the parsed query parameters as a queryParams
+	// group, with those named in RedactQueryParams masked like redacted
+	// headers. Multi-value parameters are rendered like headers. The
+	// RedactQueryParams values are also masked in requestURL, the query
+	// field and access log lines.
+	LogQueryParams    bool
+	RedactQueryParams []string
+
+	// Hostname is logged on every line as hostname to identify the
+	// instance. Defaults to os.Hostname().
+	Hostname string
+
+	// SchemaVersion is logged on every line as schemaVersion, so parsers
+	// can tell field layouts apart.
+	SchemaVersion string
+
+	// PreserveServiceCase logs the service name passed to NewLogger as
+	// is, instead of lowercasing it.
+	PreserveServiceCase bool
+
+	// LogOnlyErrors suppresses the request and response log lines of
+	// requests answered with a status below 400, unless they panicked.
+	LogOnlyErrors bool
+
+	// ResponseRequestIDHeader names a response header the request ID is
+	// echoed in, for client-side correlation.
+	ResponseRequestIDHeader string
+
+	// LogRequestStart emits the request log line even in Concise mode, so
+	// long-running requests are visible while in flight.
+	LogRequestStart bool
+
+	// RequestIDFieldName is the key of the logged request ID. Defaults to
+	// "requestID".
+	RequestIDFieldName string
+
+	// SortHeaderValues sorts the values of multi-value headers, for
+	// deterministic output. Header keys are always sorted.
+	SortHeaderValues bool
+
+	// ServerTimingHeader sets a "Server-Timing: total;dur=<ms>" response
+	// header. As headers are sent with the first write, the duration only
+	// covers the handler up to that point.
+	ServerTimingHeader bool
+
+	// RedactPlaceholder replaces masked values. Defaults to "***".
+	RedactPlaceholder string
+
+	// LogHTTP2 adds an http2 boolean request field.
+	LogHTTP2 bool
+
+	// NowFunc replaces time.Now for measuring elapsed time, e.g. with a
+	// fake clock in tests.
+	NowFunc func() time.Time
 }
 
 func Configure(opts Options) {
+	opts = setOptions(opts)
+
+	handlerOpts := &slog.HandlerOptions{
+		Level:     levelVar,
+		AddSource: opts.AddSource,
+	}
+	if opts.OmitTime || len(opts.FieldRename) > 0 || len(opts.DropFields) > 0 || opts.ReplaceAttr != nil {
+		handlerOpts.ReplaceAttr = replaceAttr
+	}
+
+	var handler slog.Handler
+	switch {
+	case opts.AccessLogFormat != "":
+		handler = newAccessLogHandler(logWriter, opts.AccessLogFormat, handlerOpts)
+	case opts.Format == FormatW3C:
+		handler = newAccessLogHandler(logWriter, FormatW3C, handlerOpts)
+	case opts.Format == FormatGELF:
+		handler = newGELFHandler(logWriter, opts.Hostname, handlerOpts)
+	case opts.Format == FormatLogfmt:
+		handler = newLogfmtHandler(logWriter, handlerOpts)
+	default:
+		handler = slog.NewJSONHandler(logWriter, handlerOpts)
+	}
+	if opts.NumericLevel {
+		handler = &severityHandler{handler}
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+// setOptions normalizes opts and makes them the DefaultOptions, setting
+// up the log writers and level. It returns the normalized options.
+func setOptions(opts Options) Options {
 	if opts.LogLevel == "" {
 		opts.LogLevel = "info"
 	}
 
+	if opts.PanicLevel == "" {
+		opts.PanicLevel = "error"
+	}
+
+	if opts.ElapsedUnit == "" {
+		opts.ElapsedUnit = "ms"
+	}
+
+	if opts.ElapsedFieldName == "" {
+		opts.ElapsedFieldName = "elapsed"
+	}
+
+	if opts.UserFieldName == "" {
+		opts.UserFieldName = "userID"
+	}
+
+	if opts.RequestIDFieldName == "" {
+		opts.RequestIDFieldName = "requestID"
+	}
+
+	if opts.RedactPlaceholder == "" {
+		opts.RedactPlaceholder = "***"
+	}
+
+	if opts.Format == "" {
+		opts.Format = FormatJSON
+	}
+
 	if opts.LevelFieldName == "" {
 		opts.LevelFieldName = "level"
 	}
@@ -48,24 +430,120 @@ func Configure(opts Options) {
 		opts.SkipHeaders[i] = strings.ToLower(header)
 	}
 
+	for i, header := range opts.RedactHeaders {
+		opts.RedactHeaders[i] = strings.ToLower(header)
+	}
+
+	for i, header := range opts.ResponseHeaders {
+		opts.ResponseHeaders[i] = strings.ToLower(header)
+	}
+
 	DefaultOptions = opts
 
-	logLevel := slog.LevelInfo
+	if asyncWriter != nil {
+		asyncWriter.Close()
+		asyncWriter = nil
+	}
+
+	logWriter = os.Stdout
+	if opts.UseStderr {
+		logWriter = os.Stderr
+	}
+	if len(opts.Writers) > 0 {
+		logWriter = io.MultiWriter(opts.Writers...)
+	}
+	if opts.Async {
+		asyncWriter = NewAsyncWriter(logWriter, opts.AsyncBufferSize, opts.AsyncBlock)
+		logWriter = asyncWriter
+	}
+
+	levelVar.Set(parseLevel(opts.LogLevel))
+	return opts
+}
+
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if DefaultOptions.OmitTime && len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	if slices.Contains(DefaultOptions.DropFields, a.Key) {
+		return slog.Attr{}
+	}
+	if name, ok := DefaultOptions.FieldRename[a.Key]; ok {
+		a.Key = name
+	}
+	if DefaultOptions.ReplaceAttr != nil {
+		return DefaultOptions.ReplaceAttr(groups, a)
+	}
+	return a
+}
+
+// SetLevel changes the minimum level of the logger set up by Configure
+// at runtime. While it is "debug", headers and bodies are logged even in
+// Concise mode.
+func SetLevel(level string) {
+	levelVar.Set(parseLevel(level))
+}
 
-	switch strings.ToLower(opts.LogLevel) {
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
 	case "debug":
-		logLevel = slog.LevelDebug
+		return slog.LevelDebug
 	case "info":
-		logLevel = slog.LevelInfo
+		return slog.LevelInfo
 	case "warn":
-		logLevel = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		logLevel = slog.LevelError
+		return slog.LevelError
 	default:
-		logLevel = slog.LevelInfo
+		return slog.LevelInfo
 	}
+}
+
+// Flush writes out any log lines still queued by the Async option or
+// held back by CoalesceWindow.
+func Flush() {
+	flushCoalescers()
+	if asyncWriter != nil {
+		asyncWriter.Flush()
+	}
+}
 
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: logLevel,
-	})))
+// Shutdown flushes the log lines still held back, as Flush does, and
+// closes the configured Writers that implement io.Closer (other than
+// stdout and stderr). It should be called once, before the process exits.
+func Shutdown(ctx context.Context) error {
+	flushCoalescers()
+	if asyncWriter != nil {
+		done := make(chan struct{})
+		go func() {
+			asyncWriter.Close()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var errs []error
+	for _, w := range DefaultOptions.Writers {
+		if w == os.Stdout || w == os.Stderr {
+			continue
+		}
+		if c, ok := w.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DroppedLogs returns the number of log lines dropped by the Async option
+// because its queue was full.
+func DroppedLogs() int64 {
+	if asyncWriter != nil {
+		return asyncWriter.Dropped()
+	}
+	return 0
 }
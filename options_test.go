@@ -0,0 +1,257 @@
+package httpslog
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAddSource(t *testing.T) {
+	for _, addSource := range []bool{false, true} {
+		logger, buf := testLogger(t, Options{AddSource: addSource})
+		serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+		source, ok := lastLine(t, buf)["source"].(map[string]any)
+		if ok != addSource {
+			t.Fatalf("AddSource=%v: source = %v", addSource, source)
+		}
+		if addSource && (source["file"] == "" || source["line"] == nil) {
+			t.Errorf("source has no file and line: %v", source)
+		}
+	}
+}
+
+func TestWriters(t *testing.T) {
+	first, second := &bytes.Buffer{}, &bytes.Buffer{}
+	logger, _ := testLogger(t, Options{Writers: []io.Writer{first, second}})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	if first.Len() == 0 || first.String() != second.String() {
+		t.Errorf("writers got different entries:\n%s\n%s", first, second)
+	}
+	if n := len(logLines(t, first)); n != 2 {
+		t.Errorf("got %d lines, want 2", n)
+	}
+}
+
+func TestOmitTime(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		logger, buf := testLogger(t, Options{OmitTime: omit})
+		serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+		for _, line := range logLines(t, buf) {
+			if _, ok := line["time"]; ok == omit {
+				t.Errorf("OmitTime=%v: time present = %v", omit, ok)
+			}
+		}
+	}
+}
+
+func TestFieldRename(t *testing.T) {
+	logger, buf := testLogger(t, Options{FieldRename: map[string]string{"msg": "message", "status": "statusCode"}})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if line["message"] != "Response: 200 OK" || line["msg"] != nil {
+		t.Errorf("msg not renamed to message: %v", line)
+	}
+	if got := field(line, "httpResponse", "statusCode"); got != float64(200) {
+		t.Errorf("httpResponse.statusCode = %v, want 200", got)
+	}
+	if got := field(line, "httpResponse", "bytes"); got != float64(2) {
+		t.Errorf("httpResponse.bytes = %v, want it unchanged", got)
+	}
+}
+
+func TestDropFields(t *testing.T) {
+	logger, buf := testLogger(t, Options{DropFields: []string{"proto", "header"}})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept", "text/plain")
+	serve(logger, okHandler, req)
+
+	for _, key := range []string{`"proto"`, `"header"`} {
+		if bytes.Contains(buf.Bytes(), []byte(key)) {
+			t.Errorf("dropped field %s logged:\n%s", key, buf)
+		}
+	}
+}
+
+// closeBuffer is a syncBuffer recording whether it was closed.
+type closeBuffer struct {
+	syncBuffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	buf := &closeBuffer{}
+	logger := NewLogger("test", Options{Async: true, AsyncBlock: true, AsyncBufferSize: 4, Writers: []io.Writer{buf}})
+	t.Cleanup(func() { Configure(Options{}) })
+	for i := 0; i < 50; i++ {
+		serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+	}
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 100 {
+		t.Errorf("got %d lines after Shutdown, want 100", n)
+	}
+	if !buf.closed {
+		t.Error("writer not closed by Shutdown")
+	}
+}
+
+func TestLoggerTags(t *testing.T) {
+	api, apiBuf := testLogger(t, Options{Tags: map[string]string{"team": "api"}})
+	buf := &bytes.Buffer{}
+	web := NewLoggerFromHandler("web", slog.NewJSONHandler(buf, nil), Options{Tags: map[string]string{"team": "web"}})
+
+	serve(api, okHandler, httptest.NewRequest("GET", "/users", nil))
+	serve(web, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	if got := field(lastLine(t, apiBuf), "tags", "team"); got != "api" {
+		t.Errorf("api logger tags.team = %v, want api", got)
+	}
+	if got := field(lastLine(t, buf), "tags", "team"); got != "web" {
+		t.Errorf("web logger tags.team = %v, want web", got)
+	}
+}
+
+func TestNewLoggerFromHandlerOptions(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLoggerFromHandler("test", slog.NewJSONHandler(buf, nil), Options{
+		Concise:     true,
+		LogLevel:    "debug",
+		FieldRename: map[string]string{"httpResponse": "response"},
+	})
+	t.Cleanup(func() { Configure(Options{}) })
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if _, ok := line["response"]; !ok {
+		t.Errorf("httpResponse group not renamed: %v", line)
+	}
+	if n := len(logLines(t, buf)); n != 2 {
+		t.Errorf("got %d lines, want the request line too with LogLevel debug", n)
+	}
+}
+
+func TestReplaceAttr(t *testing.T) {
+	var groups [][]string
+	logger, buf := testLogger(t, Options{
+		Concise: true,
+		ReplaceAttr: func(g []string, a slog.Attr) slog.Attr {
+			if a.Key == "status" {
+				groups = append(groups, g)
+				a.Key = strings.ToUpper(a.Key)
+			}
+			return a
+		},
+	})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	response, _ := field(lastLine(t, buf), "httpResponse").(map[string]any)
+	if response["STATUS"] != float64(200) {
+		t.Errorf("STATUS = %v, want 200: %v", response["STATUS"], response)
+	}
+	if _, ok := response["status"]; ok {
+		t.Errorf("status kept along STATUS: %v", response)
+	}
+	if len(groups) != 1 || len(groups[0]) != 1 || groups[0][0] != "httpResponse" {
+		t.Errorf("ReplaceAttr groups = %v, want [[httpResponse]]", groups)
+	}
+}
+
+func TestPreserveServiceCase(t *testing.T) {
+	t.Cleanup(func() { Configure(Options{}) })
+	for _, tt := range []struct {
+		preserve bool
+		want     string
+	}{
+		{false, "paymentsapi"},
+		{true, "PaymentsAPI"},
+	} {
+		var buf bytes.Buffer
+		logger := NewLogger("PaymentsAPI", Options{Writers: []io.Writer{&buf}, PreserveServiceCase: tt.preserve})
+		logger.Info("hello")
+		if got := lastLine(t, &buf)["service"]; got != tt.want {
+			t.Errorf("PreserveServiceCase=%t: service = %v, want %s", tt.preserve, got, tt.want)
+		}
+	}
+}
+
+// recordHandler is a slog.Handler keeping the messages and attribute
+// keys of the records it handles.
+type recordHandler struct {
+	records *[]string
+	attrs   []string
+}
+
+func (h recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h recordHandler) Handle(_ context.Context, r slog.Record) error {
+	keys := append([]string(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		keys = append(keys, a.Key)
+		return true
+	})
+	*h.records = append(*h.records, r.Message+" "+strings.Join(keys, ","))
+	return nil
+}
+
+func (h recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for _, a := range attrs {
+		h.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], a.Key)
+	}
+	return h
+}
+
+func (h recordHandler) WithGroup(string) slog.Handler { return h }
+
+func TestNewLoggerFromHandler(t *testing.T) {
+	t.Cleanup(func() { Configure(Options{}) })
+	defaultHandler := slog.Default().Handler()
+
+	var records []string
+	logger := NewLoggerFromHandler("test", recordHandler{records: &records}, Options{Concise: true, Hostname: "test-host"})
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	if len(records) != 1 || !strings.HasPrefix(records[0], "Response: 200 OK service,hostname,httpRequest,httpResponse") {
+		t.Errorf("records = %q, want the response through the given handler", records)
+	}
+	if slog.Default().Handler() != defaultHandler {
+		t.Error("NewLoggerFromHandler replaced the default logger")
+	}
+}
+
+func TestUseStderr(t *testing.T) {
+	t.Cleanup(func() { Configure(Options{}) })
+	for _, tt := range []struct {
+		opts Options
+		want io.Writer
+	}{
+		{Options{}, os.Stdout},
+		{Options{UseStderr: true}, os.Stderr},
+	} {
+		Configure(tt.opts)
+		if logWriter != tt.want {
+			t.Errorf("UseStderr=%t: writer = %v, want %v", tt.opts.UseStderr, logWriter, tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	Configure(Options{UseStderr: true, Writers: []io.Writer{&buf}})
+	if logWriter == os.Stderr {
+		t.Error("UseStderr overrode the configured Writers")
+	}
+}
@@ -0,0 +1,64 @@
+package httpslog
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// lineQueue is a bounded queue of log lines consumed by a background
+// goroutine. Lines are pushed and the queue is closed under the same
+// lock, so no line can be queued once the consumer has been told to
+// drain and stop.
+type lineQueue struct {
+	mu      sync.RWMutex
+	closed  bool
+	records chan []byte
+	quit    chan struct{}
+	dropped atomic.Int64
+}
+
+func newLineQueue(size int) *lineQueue {
+	return &lineQueue{
+		records: make(chan []byte, size),
+		quit:    make(chan struct{}),
+	}
+}
+
+// push queues a copy of p. When the queue is full, it waits for room if
+// block is set, and drops (and counts) the line otherwise. It returns
+// false if the queue is closed.
+func (q *lineQueue) push(p []byte, block bool) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	// The slog handler reuses its buffer, so keep a copy.
+	rec := append([]byte(nil), p...)
+
+	if block {
+		q.records <- rec
+		return true
+	}
+
+	select {
+	case q.records <- rec:
+	default:
+		q.dropped.Add(1)
+	}
+	return true
+}
+
+// close stops accepting lines and closes quit, telling the consumer to
+// drain the queue. It is safe to call more than once.
+func (q *lineQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.quit)
+	}
+}
@@ -0,0 +1,93 @@
+package httpslog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chunk is a bit over half the smallest rotation size of 1 MB, so every
+// second write rotates.
+var chunk = bytes.Repeat([]byte("x"), 600*1024)
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := NewRotatingFile(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write(chunk); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	for _, p := range []string{path, backupPath(path, 1), backupPath(path, 2)} {
+		if got := fileSize(t, p); got != int64(len(chunk)) {
+			t.Errorf("%s is %d bytes, want %d", filepath.Base(p), got, len(chunk))
+		}
+	}
+	if _, err := os.Stat(backupPath(path, 3)); !os.IsNotExist(err) {
+		t.Errorf("backup beyond maxBackups kept: %v", err)
+	}
+}
+
+func TestRotatingFileRenameError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := NewRotatingFile(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A non-empty directory in place of the backup makes the rename fail.
+	blocker := backupPath(path, 1)
+	if err := os.MkdirAll(filepath.Join(blocker, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := f.Write(chunk); err != nil {
+			t.Fatalf("write %d with rotation blocked: %v", i, err)
+		}
+	}
+	if got := fileSize(t, path); got != 2*int64(len(chunk)) {
+		t.Errorf("app.log is %d bytes, want both writes in it", got)
+	}
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(chunk); err != nil {
+		t.Fatalf("write after unblocking: %v", err)
+	}
+	if got := fileSize(t, blocker); got != 2*int64(len(chunk)) {
+		t.Errorf("app.log.1 is %d bytes, want the rotated file", got)
+	}
+	if got := fileSize(t, path); got != int64(len(chunk)) {
+		t.Errorf("app.log is %d bytes after rotating, want %d", got, len(chunk))
+	}
+}
+
+func TestRotatingFileClosed(t *testing.T) {
+	f, err := NewRotatingFile(filepath.Join(t.TempDir(), "app.log"), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := f.Write([]byte("x")); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v, want os.ErrClosed", err)
+	}
+}
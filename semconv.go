@@ -0,0 +1,65 @@
+package httpslog
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+// semConvKeys maps our field names onto OpenTelemetry HTTP semantic
+// convention attribute names.
+var semConvKeys = map[string]string{
+	"requestURL":    "url.full",
+	"requestMethod": "http.request.method",
+	"requestPath":   "url.path",
+	"query":         "url.query",
+	"host":          "server.address",
+	"scheme":        "url.scheme",
+	"remoteIP":      "client.address",
+	"proto":         "network.protocol.version",
+	"userAgent":     "user_agent.original",
+	"bytesIn":       "http.request.body.size",
+	"status":        "http.response.status_code",
+	"bytes":         "http.response.body.size",
+}
+
+// semConvHeaderKeys maps the httpRequest and httpResponse groups onto the
+// semantic-convention names of their headers.
+var semConvHeaderKeys = map[string]string{
+	"httpRequest":  "http.request.header",
+	"httpResponse": "http.response.header",
+}
+
+// httpFields returns fields grouped under key, e.g. httpRequest. With the
+// SemConv option, the fields are instead returned as top-level attributes
+// renamed to their semantic-convention names, and the remote address is
+// split into client.address and client.port. Fields without a mapping
+// keep their name.
+func httpFields(key string, fields []slog.Attr) []slog.Attr {
+	if !DefaultOptions.SemConv {
+		return []slog.Attr{groupAttr(key, fields)}
+	}
+
+	attrs := make([]slog.Attr, 0, len(fields)+1)
+	for _, a := range fields {
+		switch a.Key {
+		case "remoteIP":
+			host, port, err := net.SplitHostPort(a.Value.String())
+			if err != nil {
+				break
+			}
+			attrs = append(attrs, slog.String("client.address", host))
+			if n, err := strconv.Atoi(port); err == nil {
+				attrs = append(attrs, slog.Int("client.port", n))
+			}
+			continue
+		case "header":
+			a.Key = semConvHeaderKeys[key]
+		}
+		if name, ok := semConvKeys[a.Key]; ok {
+			a.Key = name
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
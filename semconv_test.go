@@ -0,0 +1,73 @@
+package httpslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSemConv(t *testing.T) {
+	logger, buf := testLogger(t, Options{SemConv: true, Concise: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "curl/8.0")
+	serve(logger, statusHandler(http.StatusNotFound), req)
+
+	line := lastLine(t, buf)
+	want := map[string]any{
+		"http.request.method":       "GET",
+		"url.path":                  "/users",
+		"url.scheme":                "http",
+		"url.full":                  "http://example.com/users",
+		"user_agent.original":       "curl/8.0",
+		"network.protocol.version":  "1.1",
+		"client.address":            "192.0.2.1",
+		"client.port":               float64(1234),
+		"http.response.status_code": float64(http.StatusNotFound),
+		"http.response.body.size":   float64(0),
+	}
+	for key, value := range want {
+		if got := line[key]; got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+	for _, key := range []string{"httpRequest", "httpResponse", "remoteIP", "requestMethod", "status"} {
+		if _, ok := line[key]; ok {
+			t.Errorf("%s logged with SemConv:\n%s", key, buf)
+		}
+	}
+}
+
+func TestSemConvHeaders(t *testing.T) {
+	logger, buf := testLogger(t, Options{SemConv: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept", "text/plain")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	serve(logger, h, req)
+
+	lines := logLines(t, buf)
+	if got := field(lines[0], "http.request.header", "accept"); got != "text/plain" {
+		t.Errorf("http.request.header.accept = %v", got)
+	}
+	if got := field(lines[1], "http.response.header", "content-type"); got != "text/plain" {
+		t.Errorf("http.response.header.content-type = %v", got)
+	}
+}
+
+func TestSemConvAnonymizeIP(t *testing.T) {
+	logger, buf := testLogger(t, Options{SemConv: true, AnonymizeIP: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	serve(logger, okHandler, req)
+
+	line := lastLine(t, buf)
+	if got := line["client.address"]; got != "192.0.2.0" {
+		t.Errorf("client.address = %v, want 192.0.2.0", got)
+	}
+	if got, ok := line["client.port"]; ok {
+		t.Errorf("client.port = %v for an anonymized address", got)
+	}
+}
@@ -0,0 +1,21 @@
+package httpslog
+
+import (
+	"bytes"
+	"log/slog"
+)
+
+// NewTestLogger returns a logger writing JSON records to an in-memory
+// buffer, so tests can assert on the fields emitted by the middleware:
+//
+//	logger, buf := httpslog.NewTestLogger()
+//	r.Use(httpslog.Handler(logger))
+//
+// The buffer is not safe for concurrent use.
+func NewTestLogger() (*slog.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	return logger, buf
+}
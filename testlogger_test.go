@@ -0,0 +1,19 @@
+package httpslog
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTestLogger(t *testing.T) {
+	logger, buf := NewTestLogger()
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	line := lastLine(t, buf)
+	if got := field(line, "httpRequest", "requestPath"); got != "/users" {
+		t.Errorf("httpRequest.requestPath = %v, want /users", got)
+	}
+	if got := field(line, "httpResponse", "status"); got != float64(200) {
+		t.Errorf("httpResponse.status = %v, want 200", got)
+	}
+}
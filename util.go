@@ -2,7 +2,20 @@ package httpslog
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // limitBuffer is used to pipe response body information from the
@@ -35,3 +48,260 @@ func (b limitBuffer) Write(p []byte) (n int, err error) {
 func (b limitBuffer) Read(p []byte) (n int, err error) {
 	return b.Buffer.Read(p)
 }
+
+// bodyCapture tees the response body into buf unless capture has been
+// disabled for the request or the response is a Server-Sent Events
+// stream, which is passed through untouched.
+type bodyCapture struct {
+	buf    io.Writer
+	header http.Header
+	entry  *RequestLoggerEntry
+}
+
+func (c bodyCapture) Write(p []byte) (n int, err error) {
+	c.entry.mu.Lock()
+	disabled := c.entry.noBodyCapture
+	c.entry.mu.Unlock()
+	if disabled || strings.HasPrefix(c.header.Get("Content-Type"), "text/event-stream") {
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// contextKey is a value for use with context.WithValue. It's used as
+// a pointer so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+var (
+	bodyHashCtxKey     = &contextKey{"BodyHash"}
+	bodyTooLargeCtxKey = &contextKey{"BodyTooLarge"}
+	forceVerboseCtxKey = &contextKey{"ForceVerbose"}
+	inFlightCtxKey     = &contextKey{"InFlight"}
+	logEntryCtxKey     = &contextKey{"LogEntry"}
+)
+
+const maxBodyHashSize = 1 << 20
+
+// withBodyHash reads up to MaxBodyHashSize of the request body, stores
+// its SHA-256 in the request context and restores the body so the
+// handler can still consume it. Empty bodies are left unhashed; larger
+// ones are flagged instead, without reading past the limit.
+func withBodyHash(r *http.Request) *http.Request {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r
+	}
+
+	limit := DefaultOptions.MaxBodyHashSize
+	if limit <= 0 {
+		limit = maxBodyHashSize
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if len(buf) > limit {
+		return r.WithContext(context.WithValue(r.Context(), bodyTooLargeCtxKey, true))
+	}
+	if err != nil || len(buf) == 0 {
+		return r
+	}
+
+	sum := sha256.Sum256(buf)
+	return r.WithContext(context.WithValue(r.Context(), bodyHashCtxKey, hex.EncodeToString(sum[:])))
+}
+
+// requestFingerprint returns a short FNV-1a hash of the request method
+// and path, and of the body hash when LogBodyHash is set, so identical
+// requests can be grouped together.
+func requestFingerprint(r *http.Request) string {
+	h := fnv.New64a()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{' '})
+	h.Write([]byte(r.URL.Path))
+	if bodyHash, ok := r.Context().Value(bodyHashCtxKey).(string); ok {
+		h.Write([]byte{' '})
+		h.Write([]byte(bodyHash))
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// readCloser pairs a replacement reader with the original body's Close.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// remoteIP returns the client address to log for r, anonymized when the
+// AnonymizeIP option is set.
+func remoteIP(r *http.Request) string {
+	if DefaultOptions.AnonymizeIP {
+		return anonymizeIP(r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
+
+// anonymizeIP strips any port from addr and zeroes the host part of the
+// address: the last octet for IPv4 and the lower 80 bits for IPv6.
+func anonymizeIP(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// groupAttr is like slog.Group but takes already built attributes.
+// ReplaceAttr is never called for groups, so FieldRename is applied to
+// the group key here, as is DropFields.
+func groupAttr(key string, attrs []slog.Attr) slog.Attr {
+	if slices.Contains(DefaultOptions.DropFields, key) {
+		return slog.Attr{}
+	}
+	if name, ok := DefaultOptions.FieldRename[key]; ok {
+		key = name
+	}
+	return slog.Attr{Key: key, Value: slog.GroupValue(attrs...)}
+}
+
+// responseBodyField returns the captured response body to log, or a
+// placeholder when the response is compressed or not textual.
+func responseBodyField(header http.Header, body []byte, size int) string {
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return fmt.Sprintf("<binary %d bytes>", size)
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+	}
+	if contentType != "" && !isTextContentType(contentType) {
+		return fmt.Sprintf("<binary %d bytes>", size)
+	}
+	return string(body)
+}
+
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json",
+		"application/xml",
+		"application/x-www-form-urlencoded",
+		"application/javascript":
+		return true
+	}
+	return false
+}
+
+// upgradeProtocol returns the lowercased protocol requested through the
+// Connection: Upgrade and Upgrade headers (e.g. "websocket"), or "".
+func upgradeProtocol(r *http.Request) string {
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return strings.ToLower(r.Header.Get("Upgrade"))
+			}
+		}
+	}
+	return ""
+}
+
+// contentLengthMismatch reports whether the handler declared a
+// Content-Length that differs from the number of bytes it wrote.
+func contentLengthMismatch(r *http.Request, status, bytes int, header http.Header) bool {
+	if r.Method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+
+	declared := header.Get("Content-Length")
+	if declared == "" {
+		return false
+	}
+	n, err := strconv.Atoi(declared)
+	return err == nil && n != bytes
+}
+
+// now returns the current time from the NowFunc option, or time.Now.
+func now() time.Time {
+	if DefaultOptions.NowFunc != nil {
+		return DefaultOptions.NowFunc()
+	}
+	return time.Now()
+}
+
+// pathLevel returns the PathLevels entry for path: an exact match, or
+// the longest "*"-suffixed prefix matching it.
+func pathLevel(path string) (slog.Level, bool) {
+	if level, ok := DefaultOptions.PathLevels[path]; ok {
+		return parseLevel(level), true
+	}
+
+	var match, level string
+	for pattern, l := range DefaultOptions.PathLevels {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(path, prefix) && len(prefix) >= len(match) {
+			match, level = prefix, l
+		}
+	}
+	if level == "" {
+		return 0, false
+	}
+	return parseLevel(level), true
+}
+
+// levelHandler overrides the minimum level of the wrapped handler, in
+// either direction.
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{h.Handler.WithGroup(name), h.level}
+}
+
+// severityHandler adds the RFC 5424 severity of each record as a
+// severityNumber field.
+type severityHandler struct {
+	slog.Handler
+}
+
+func (h *severityHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(slog.Int("severityNumber", syslogSeverity(r.Level)))
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *severityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &severityHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *severityHandler) WithGroup(name string) slog.Handler {
+	return &severityHandler{h.Handler.WithGroup(name)}
+}
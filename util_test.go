@@ -0,0 +1,142 @@
+package httpslog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogBodyHash(t *testing.T) {
+	logger, buf := testLogger(t, Options{LogBodyHash: true})
+
+	const body = `{"name":"alice"}`
+	var read string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		read = string(b)
+	})
+	serve(logger, h, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+
+	if read != body {
+		t.Errorf("handler read %q, want the restored body %q", read, body)
+	}
+	sum := sha256.Sum256([]byte(body))
+	if got := field(lastLine(t, buf), "httpRequest", "bodyHash"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("bodyHash = %v, want %x", got, sum)
+	}
+}
+
+func TestLogBodyHashEmpty(t *testing.T) {
+	logger, buf := testLogger(t, Options{LogBodyHash: true})
+	serve(logger, okHandler, httptest.NewRequest("POST", "/users", strings.NewReader("")))
+	serve(logger, okHandler, httptest.NewRequest("GET", "/users", nil))
+
+	for _, line := range logLines(t, buf) {
+		if got := field(line, "httpRequest", "bodyHash"); got != nil {
+			t.Errorf("bodyHash = %v for an empty body", got)
+		}
+	}
+}
+
+// slowReader trickles its body one byte per Read, like a slow client,
+// counting the reads.
+type slowReader struct {
+	remaining int
+	reads     int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	r.remaining--
+	r.reads++
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestMaxBodyHashSize(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, LogBodyHash: true, MaxBodyHashSize: 16})
+
+	body := &slowReader{remaining: 1000}
+	var readBefore, handlerRead int
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readBefore = body.reads
+		b, _ := io.ReadAll(r.Body)
+		handlerRead = len(b)
+	})
+	serve(logger, h, httptest.NewRequest("POST", "/upload", body))
+
+	if readBefore > 17 {
+		t.Errorf("read %d bytes ahead of the handler, want at most the 16 byte cap and one more", readBefore)
+	}
+	if handlerRead != 1000 {
+		t.Errorf("handler read %d bytes, want the whole body of 1000", handlerRead)
+	}
+	line := lastLine(t, buf)
+	if got := field(line, "httpRequest", "bodyTooLarge"); got != true {
+		t.Errorf("bodyTooLarge = %v, want true", got)
+	}
+	if got := field(line, "httpRequest", "bodyHash"); got != nil {
+		t.Errorf("bodyHash = %v for a body over the cap", got)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	logger, buf := testLogger(t, Options{Concise: true, Fingerprint: true, LogBodyHash: true})
+	fingerprint := func(method, target, body string) any {
+		buf.Reset()
+		serve(logger, okHandler, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return field(lastLine(t, buf), "httpRequest", "requestFingerprint")
+	}
+
+	first := fingerprint("POST", "/orders", `{"id":1}`)
+	if s, _ := first.(string); s == "" {
+		t.Fatalf("requestFingerprint = %v, want a hash", first)
+	}
+	if got := fingerprint("POST", "/orders", `{"id":1}`); got != first {
+		t.Errorf("identical request fingerprint = %v, want %v", got, first)
+	}
+	for _, tt := range []struct{ method, target, body string }{
+		{"PUT", "/orders", `{"id":1}`},
+		{"POST", "/users", `{"id":1}`},
+		{"POST", "/orders", `{"id":2}`},
+	} {
+		if got := fingerprint(tt.method, tt.target, tt.body); got == first {
+			t.Errorf("%s %s %s: fingerprint %v matches a different request", tt.method, tt.target, tt.body, got)
+		}
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.42", "203.0.113.0"},
+		{"203.0.113.42:8080", "203.0.113.0"},
+		{"2001:db8:85a3:1234:5678:8a2e:370:7334", "2001:db8:85a3::"},
+		{"[2001:db8:85a3:1234::1]:443", "2001:db8:85a3::"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := anonymizeIP(tt.addr); got != tt.want {
+			t.Errorf("anonymizeIP(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestAnonymizeIPOption(t *testing.T) {
+	logger, buf := testLogger(t, Options{AnonymizeIP: true})
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.RemoteAddr = "203.0.113.42:8080"
+	serve(logger, okHandler, req)
+
+	if got := field(lastLine(t, buf), "httpRequest", "remoteIP"); got != "203.0.113.0" {
+		t.Errorf("remoteIP = %v, want 203.0.113.0", got)
+	}
+}